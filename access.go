@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	pathpkg "path"
+	"sort"
+	"strings"
+)
+
+// Access control is configured with named sections, e.g.
+//
+//   [access "artists"]
+//       users = alice, bob
+//       groups = art
+//       paths = games/*, art/**
+//       permission = write
+//
+//   [group "art"]
+//       members = carol, dave
+//
+// A user gets the highest permission of all the rules which match them and the
+// repo path. If no access rules are configured at all, everyone has write access
+// to every path (but not admin).
+
+type Permission int
+
+const (
+	PermissionNone Permission = iota
+	PermissionRead
+	PermissionWrite
+	PermissionAdmin
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermissionRead:
+		return "read"
+	case PermissionWrite:
+		return "write"
+	case PermissionAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func ParsePermission(s string) (Permission, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "none":
+		return PermissionNone, nil
+	case "read":
+		return PermissionRead, nil
+	case "write":
+		return PermissionWrite, nil
+	case "admin":
+		return PermissionAdmin, nil
+	}
+	return PermissionNone, fmt.Errorf("Unknown permission '%v'", s)
+}
+
+type AccessRule struct {
+	Name       string
+	Users      []string
+	Groups     []string
+	Paths      []string
+	Permission Permission
+}
+
+// The SSH user a session is running for
+type User struct {
+	Name   string
+	Groups []string
+}
+
+func (u *User) String() string {
+	if u == nil || u.Name == "" {
+		return "(anonymous)"
+	}
+	return u.Name
+}
+
+func (u *User) inGroup(group string) bool {
+	if u == nil {
+		return false
+	}
+	// group names from config sections are always lower case
+	for _, g := range u.Groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AccessRule) matchesUser(u *User) bool {
+	return matchUser(r.Users, r.Groups, u)
+}
+
+func (r *AccessRule) matchesPath(p string) bool {
+	return matchAnyPathGlob(r.Paths, p)
+}
+
+// Whether u is one of users ('*' for anyone) or in one of groups
+func matchUser(users, groups []string, u *User) bool {
+	for _, name := range users {
+		if name == "*" || (u != nil && name == u.Name) {
+			return true
+		}
+	}
+	for _, g := range groups {
+		if u.inGroup(g) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyPathGlob(globs []string, p string) bool {
+	for _, glob := range globs {
+		if matchPathGlob(glob, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match a repo path against a glob where each path segment is matched as per
+// path.Match, plus '**' which matches any number of segments (including none)
+func matchPathGlob(glob, p string) bool {
+	glob = strings.Trim(toSlash(glob), "/")
+	p = strings.Trim(toSlash(p), "/")
+	return matchSegments(strings.Split(glob, "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(glob, p []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(p); i++ {
+				if matchSegments(glob[1:], p[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(p) == 0 {
+			return false
+		}
+		if ok, err := pathpkg.Match(glob[0], p[0]); err != nil || !ok {
+			return false
+		}
+		glob = glob[1:]
+		p = p[1:]
+	}
+	return len(p) == 0
+}
+
+func toSlash(p string) string {
+	return strings.Replace(p, "\\", "/", -1)
+}
+
+// Work out what a user is allowed to do to a repo path
+func (c *Config) PermissionFor(u *User, path string) Permission {
+	if len(c.AccessRules) == 0 {
+		return PermissionWrite
+	}
+	perm := PermissionNone
+	for _, r := range c.AccessRules {
+		if r.Permission > perm && r.matchesUser(u) && r.matchesPath(path) {
+			perm = r.Permission
+		}
+	}
+	return perm
+}
+
+// Permission needed for a method or command listed in perms; anything which
+// isn't listed needs admin, so nothing is left open by mistake
+func requiredPermission(perms map[string]Permission, name string) Permission {
+	if p, ok := perms[name]; ok {
+		return p
+	}
+	return PermissionAdmin
+}
+
+// Build access rules & groups from the [access "name"] and [group "name"] sections
+// of the config settings
+func parseAccessSettings(settings map[string]string, cfg *Config) {
+	rules := make(map[string]*AccessRule)
+	for key, val := range settings {
+		if !strings.HasPrefix(key, "access.") {
+			continue
+		}
+		dot := strings.LastIndex(key, ".")
+		if dot <= len("access.") {
+			continue
+		}
+		name := key[len("access."):dot]
+		r, ok := rules[name]
+		if !ok {
+			r = &AccessRule{Name: name}
+			rules[name] = r
+		}
+		switch key[dot+1:] {
+		case "users":
+			r.Users = splitList(val)
+		case "groups":
+			r.Groups = splitList(val)
+		case "paths":
+			r.Paths = splitList(val)
+		case "permission":
+			var err error
+			r.Permission, err = ParsePermission(val)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid configuration: access.%v.permission=%v\n", name, val)
+			}
+		}
+	}
+	// Sort so behaviour doesn't depend on map ordering
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg.AccessRules = append(cfg.AccessRules, rules[name])
+	}
+
+	for key, val := range settings {
+		if strings.HasPrefix(key, "group.") && strings.HasSuffix(key, ".members") && len(key) > len("group..members") {
+			name := key[len("group.") : len(key)-len(".members")]
+			if cfg.Groups == nil {
+				cfg.Groups = make(map[string][]string)
+			}
+			cfg.Groups[name] = splitList(val)
+		}
+	}
+}
+
+// Split a comma or space separated config list
+func splitList(val string) []string {
+	return strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// Identify the user a session is for. name is the user given to a forced
+// command in authorized_keys, if blank then $USER or the OS user is used.
+// Groups come from the config plus the OS groups of the user, if it's a real account.
+func IdentifyUser(name string, cfg *Config) *User {
+	if name == "" {
+		name = os.Getenv("USER")
+	}
+	if name == "" {
+		if cur, err := user.Current(); err == nil {
+			name = cur.Username
+		}
+	}
+	u := &User{Name: name}
+	if name == "" {
+		return u
+	}
+	for group, members := range cfg.Groups {
+		for _, m := range members {
+			if m == name {
+				u.Groups = append(u.Groups, group)
+				break
+			}
+		}
+	}
+	if osuser, err := user.Lookup(name); err == nil {
+		if gids, err := osuser.GroupIds(); err == nil {
+			for _, gid := range gids {
+				if g, err := user.LookupGroupId(gid); err == nil {
+					u.Groups = append(u.Groups, g.Name)
+				}
+			}
+		}
+	}
+	sort.Strings(u.Groups)
+	return u
+}
+
+// Programs a client may ask to run, i.e. this one or as git-lfs-transfer or
+// git-lfs-authenticate
+var allowedPrograms = map[string]bool{
+	"git-lfs-ssh-serve": true,
+	transferProgram:     true,
+	authenticateProgram: true,
+}
+
+// Get the program & arguments from SSH_ORIGINAL_COMMAND, for when we're run as
+// a forced command which doesn't pass them itself
+func parseOriginalCommand(cmd string) (program string, args []string, err error) {
+	fields := strings.Fields(cmd)
+	if len(fields) < 2 {
+		return "", nil, fmt.Errorf("Path argument missing from command '%v'", cmd)
+	}
+	program = programName(fields[0])
+	if !allowedPrograms[program] {
+		return "", nil, fmt.Errorf("Command '%v' is not allowed", fields[0])
+	}
+	for _, f := range fields[1:] {
+		args = append(args, strings.Trim(f, `'"`))
+	}
+	return program, args, nil
+}
+
+// Name a program was run as, without any directory or extension
+func programName(arg0 string) string {
+	return strings.TrimSuffix(pathpkg.Base(toSlash(arg0)), ".exe")
+}
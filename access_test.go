@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Access control", func() {
+
+	var config *Config
+
+	BeforeEach(func() {
+		settings, err := ReadConfigStream(strings.NewReader(`
+base-path = /tmp
+[access "artists"]
+    groups = art
+    paths = games/**
+    permission = write
+[access "everyone"]
+    users = *
+    paths = games/*, shared/**
+    permission = read
+[access "admins"]
+    users = root
+    paths = **
+    permission = admin
+[group "art"]
+    members = alice, bob
+`), "")
+		Expect(err).To(BeNil(), "Should be able to read config")
+		config = NewConfig()
+		parseAccessSettings(settings, config)
+	})
+
+	It("Matches path globs", func() {
+		Expect(matchPathGlob("games/*", "games/tetris")).To(BeTrue())
+		Expect(matchPathGlob("games/*", "games/tetris/art")).To(BeFalse())
+		Expect(matchPathGlob("games/**", "games/tetris/art")).To(BeTrue())
+		Expect(matchPathGlob("games/**", "games")).To(BeTrue())
+		Expect(matchPathGlob("**", "anything/at/all")).To(BeTrue())
+		Expect(matchPathGlob("games/*/art", "games/tetris/art")).To(BeTrue())
+		Expect(matchPathGlob("games/*", "other/tetris")).To(BeFalse())
+		Expect(matchPathGlob(`games\*`, "games/tetris")).To(BeTrue())
+	})
+
+	It("Resolves permissions from rules", func() {
+		alice := &User{Name: "alice", Groups: []string{"art"}}
+		carol := &User{Name: "carol"}
+		root := &User{Name: "root"}
+		Expect(config.AccessRules).To(HaveLen(3), "Should have parsed all the rules")
+		Expect(config.Groups).To(HaveKey("art"), "Should have parsed groups")
+		Expect(config.PermissionFor(alice, "games/tetris")).To(Equal(PermissionWrite))
+		Expect(config.PermissionFor(carol, "games/tetris")).To(Equal(PermissionRead))
+		Expect(config.PermissionFor(carol, "games/tetris/art")).To(Equal(PermissionNone))
+		Expect(config.PermissionFor(alice, "private/stuff")).To(Equal(PermissionNone))
+		Expect(config.PermissionFor(nil, "shared/x")).To(Equal(PermissionRead))
+		Expect(config.PermissionFor(root, "private/stuff")).To(Equal(PermissionAdmin))
+
+		Expect(NewConfig().PermissionFor(carol, "anything")).To(Equal(PermissionWrite), "No rules should mean write access")
+	})
+
+	It("Identifies users", func() {
+		u := IdentifyUser("bob", config)
+		Expect(u.Name).To(Equal("bob"))
+		Expect(u.Groups).To(ContainElement("art"), "Should get groups from config")
+	})
+
+	It("Has a permission for every method and command", func() {
+		for method := range methodMap {
+			Expect(methodPermissions).To(HaveKey(method), "Method %v needs a permission", method)
+		}
+		for command := range transferCommands {
+			Expect(transferPermissions).To(HaveKey(command), "Command %v needs a permission", command)
+		}
+		Expect(requiredPermission(methodPermissions, "NotListed")).To(Equal(PermissionAdmin))
+	})
+
+	It("Gets the path from the original command", func() {
+		prog, args, err := parseOriginalCommand("git-lfs-ssh-serve 'games/tetris'")
+		Expect(err).To(BeNil())
+		Expect(prog).To(Equal("git-lfs-ssh-serve"))
+		Expect(args).To(Equal([]string{"games/tetris"}))
+		prog, args, err = parseOriginalCommand("/usr/bin/git-lfs-transfer 'games/tetris' upload")
+		Expect(err).To(BeNil())
+		Expect(prog).To(Equal("git-lfs-transfer"))
+		Expect(args).To(Equal([]string{"games/tetris", "upload"}))
+		prog, args, err = parseOriginalCommand("git-lfs-authenticate 'games/tetris' download " + strings.Repeat("a", 64))
+		Expect(err).To(BeNil())
+		Expect(prog).To(Equal("git-lfs-authenticate"))
+		Expect(args).To(HaveLen(3))
+		_, _, err = parseOriginalCommand("rm -rf /")
+		Expect(err).ToNot(BeNil(), "Other commands should be refused")
+		_, _, err = parseOriginalCommand("git-lfs-ssh-serve")
+		Expect(err).ToNot(BeNil(), "Path is required")
+	})
+
+	It("Refuses uploads for read-only users", func() {
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		defer os.RemoveAll(config.BasePath)
+		content := []byte("some content which can be read but not written")
+		oid := oidFor(content)
+		filename, _ := mediaPath(oid, config, "games/tetris")
+		ensureDirExists(filepath.Dir(filename), config)
+		Expect(ioutil.WriteFile(filename, content, 0644)).To(Succeed())
+
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+		go Serve(srv, srv, &outerr, config, "games/tetris", &User{Name: "carol"})
+		defer cli.Close()
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+
+		_, wrerr := ctx.UploadCheck(oidFor([]byte("new")), 3)
+		Expect(wrerr).ToNot(BeNil(), "Read-only user should not be able to upload")
+		Expect(wrerr.Error()).To(ContainSubstring("Permission denied"))
+
+		objs, wrerr := ctx.Batch([]*lfs.ObjectResource{&lfs.ObjectResource{Oid: oid}})
+		Expect(wrerr).To(BeNil(), "Read-only user should be able to Batch")
+		Expect(objs).To(HaveLen(1))
+		rdr, sz, wrerr := ctx.Download(oid)
+		Expect(wrerr).To(BeNil(), "Read-only user should be able to download")
+		var buf bytes.Buffer
+		buf.ReadFrom(lfs.LimitReadCloser(rdr, sz))
+		Expect(buf.Bytes()).To(Equal(content))
+
+		ctx.Close()
+	})
+})
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"io"
+)
+
+// A maintenance subcommand, e.g. git-lfs-ssh-serve gc; returns the exit code
+type subcommandFunc func(cfg *Config, user *User, args []string, out io.Writer) int
+
+var subcommands = map[string]subcommandFunc{
+	"gc":         runGC,
+	"fsck":       runFsck,
+	"serve-http": runServeHTTP,
+}
+
+// Parse flags which may appear before, after or between positional arguments,
+// returning the positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// Subcommands can change or remove content, so need admin access to path if any
+// access rules are configured. Returns a non-zero exit code if not allowed.
+func requireAdmin(cfg *Config, user *User, path string) int {
+	if len(cfg.AccessRules) == 0 {
+		return 0
+	}
+	if cfg.PermissionFor(user, path) < PermissionAdmin {
+		outputf("Access denied, %v does not have admin access to %v\n", user, path)
+		return 20
+	}
+	return 0
+}
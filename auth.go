@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// git-lfs-authenticate <path> <upload|download> [oid]
+//
+// Run by git-lfs over SSH when it's going to use the HTTP API. Prints JSON with
+// the href of the API for path and an Authorization header carrying a signed
+// token, which serve-http accepts until it expires. The token is an encoded
+// "user, path, operation, expiry" payload and an HMAC of it using auth-secret.
+
+const authenticateProgram = "git-lfs-authenticate"
+
+// The response git-lfs expects from git-lfs-authenticate
+type AuthenticateResponse struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header"`
+	ExpiresAt string            `json:"expires_at"`
+}
+
+// What a valid token allows
+type authToken struct {
+	User      string
+	Path      string
+	Operation string
+	Expires   time.Time
+}
+
+// Whether the token allows operation; an upload token is also good for downloads
+func (t *authToken) allows(operation string) bool {
+	return t.Operation == operation || t.Operation == transferUpload
+}
+
+func runAuthenticate(cfg *Config, user *User, path, operation string, out io.Writer) int {
+	if cfg.AuthSecret == "" || cfg.HTTPURL == "" {
+		outputf("%v is not available, auth-secret and http-url must be configured\n", authenticateProgram)
+		return 26
+	}
+	required := PermissionRead
+	if operation == transferUpload {
+		required = PermissionWrite
+	}
+	if cfg.PermissionFor(user, path) < required {
+		outputf("Access denied, %v does not have %v access to %v\n", user, required, path)
+		return 20
+	}
+	expires := time.Now().Add(cfg.AuthTokenExpiry)
+	token := issueToken(cfg.AuthSecret, &authToken{User: user.Name, Path: path, Operation: operation, Expires: expires})
+	resp := &AuthenticateResponse{
+		Href:      strings.TrimSuffix(cfg.HTTPURL, "/") + "/" + toSlash(path),
+		Header:    map[string]string{"Authorization": "Bearer " + token},
+		ExpiresAt: expires.UTC().Format(time.RFC3339),
+	}
+	if err := json.NewEncoder(out).Encode(resp); err != nil {
+		outputf("Unable to write response: %v\n", err.Error())
+		return 23
+	}
+	logf("Issued %v token for %v, expires %v\n", operation, user, resp.ExpiresAt)
+	return 0
+}
+
+func issueToken(secret string, t *authToken) string {
+	payload := strings.Join([]string{t.User, toSlash(t.Path), t.Operation, strconv.FormatInt(t.Expires.Unix(), 10)}, "\n")
+	encoded := base64.URLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + signToken(secret, encoded)
+}
+
+func signToken(secret, encoded string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check a token's signature and expiry, returning what it allows
+func verifyToken(secret, token string, now time.Time) (*authToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(signToken(secret, parts[0]))) {
+		return nil, fmt.Errorf("Invalid token signature")
+	}
+	payload, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed token")
+	}
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+	expires, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed token")
+	}
+	t := &authToken{User: fields[0], Path: fields[1], Operation: fields[2], Expires: time.Unix(expires, 0)}
+	if now.After(t.Expires) {
+		return nil, fmt.Errorf("Token expired at %v", t.Expires.UTC().Format(time.RFC3339))
+	}
+	return t, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Optional features are negotiated with Version. The response lists every
+// capability the server supports; the client lists the ones it wants in the
+// request and the response says which of those are enabled for the session.
+//
+// Clients which don't ask for any capabilities (including all older clients)
+// get the original behaviour, where every method the server has is available.
+// Once a client has asked for capabilities, methods & options belonging to
+// ones it didn't ask for are refused, so that it only sees what it understands.
+// Capabilities the server doesn't know are ignored, so newer clients can ask
+// for things older servers don't have.
+
+const (
+	// Uploaded content is checked against its oid before it's stored
+	capabilityVerification = "verification"
+	// UploadStatus & UploadResume
+	capabilityResume = "resume"
+	// UploadDelta & DownloadDelta
+	capabilityDeltas = "deltas"
+	// Chunked Download
+	capabilityChunked = "chunked"
+	// Switching to framed mode, same as asking for multiplex framing
+	capabilityFraming = "framing"
+	// Compressed Upload & chunked Download content
+	capabilityCompression = "compression"
+	// LockCreate, LockList, LockDelete & LockVerify
+	capabilityLocking = "locking"
+)
+
+type capabilityInfo struct {
+	name string
+	// Whether it's available with this configuration
+	supported func(config *Config) bool
+}
+
+func alwaysSupported(config *Config) bool {
+	return true
+}
+
+// All capabilities, in the order they're reported
+var capabilityList = []capabilityInfo{
+	{capabilityVerification, alwaysSupported},
+	{capabilityResume, alwaysSupported},
+	{capabilityDeltas, func(config *Config) bool { return config.EnableDeltaReceive || config.EnableDeltaSend }},
+	{capabilityChunked, alwaysSupported},
+	{capabilityFraming, alwaysSupported},
+	{capabilityCompression, alwaysSupported},
+	{capabilityLocking, alwaysSupported},
+}
+
+// Capability each method belongs to, if it's optional
+var methodCapabilities = map[string]string{
+	"UploadStatus":  capabilityResume,
+	"UploadResume":  capabilityResume,
+	"UploadDelta":   capabilityDeltas,
+	"DownloadDelta": capabilityDeltas,
+	"LockCreate":    capabilityLocking,
+	"LockList":      capabilityLocking,
+	"LockDelete":    capabilityLocking,
+	"LockVerify":    capabilityLocking,
+}
+
+// Request for Version, which may ask for capabilities and/or to switch to a framed protocol
+type VersionRequest struct {
+	Framing      string   `json:"framing,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Response to Version; Framing is set if the session switches to framed mode
+// after this response
+type VersionResponse struct {
+	Major   int    `json:"major"`
+	Minor   int    `json:"minor"`
+	Patch   int    `json:"patch"`
+	Framing string `json:"framing,omitempty"`
+	// Everything this server supports
+	Capabilities []string `json:"capabilities"`
+	// Which of the requested capabilities are enabled for this session
+	Enabled []string `json:"enabled,omitempty"`
+	// Content encodings available for compression
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+func supportedCapabilities(config *Config) []string {
+	var names []string
+	for _, c := range capabilityList {
+		if c.supported(config) {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+// Enable those of requested which are supported, returning them
+func (s *Session) enableCapabilities(requested []string, config *Config) []string {
+	want := make(map[string]bool, len(requested))
+	for _, name := range requested {
+		want[name] = true
+	}
+	s.Capabilities = make(map[string]bool)
+	var enabled []string
+	for _, name := range supportedCapabilities(config) {
+		if want[name] {
+			s.Capabilities[name] = true
+			enabled = append(enabled, name)
+		}
+	}
+	return enabled
+}
+
+func (s *Session) enabledCapabilities() []string {
+	var enabled []string
+	for _, c := range capabilityList {
+		if s.Capabilities[c.name] {
+			enabled = append(enabled, c.name)
+		}
+	}
+	return enabled
+}
+
+// Whether a capability can be used in this session
+func (s *Session) capabilityEnabled(name string) bool {
+	if s.Capabilities == nil {
+		// Client never negotiated, so everything is available as it always was
+		return true
+	}
+	return s.Capabilities[name]
+}
+
+// Error message if a method can't be used in this session because its capability isn't enabled
+func capabilityError(method string, sess *Session) string {
+	if name, ok := methodCapabilities[method]; ok && !sess.capabilityEnabled(name) {
+		return fmt.Sprintf("%v needs the '%v' capability, which was not enabled for this session", method, name)
+	}
+	return ""
+}
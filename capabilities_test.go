@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Capability negotiation", func() {
+
+	var config *Config
+	var cli net.Conn
+	var rdr *bufio.Reader
+	var done chan int
+	var oid string
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		oid = oidFor([]byte("content"))
+	})
+	AfterEach(func() {
+		cli.Close()
+		<-done
+		os.RemoveAll(config.BasePath)
+	})
+
+	start := func() {
+		var srv net.Conn
+		cli, srv = net.Pipe()
+		done = make(chan int, 1)
+		go func() {
+			done <- Serve(srv, srv, GinkgoWriter, config, "test/repo", nil)
+			srv.Close()
+		}()
+		rdr = bufio.NewReader(cli)
+	}
+	negotiate := func(params *VersionRequest) VersionResponse {
+		sendRawRequest(cli, "Version", params)
+		ver := VersionResponse{}
+		resp := readRawResponse(rdr, &ver)
+		Expect(resp.Error).To(BeNil(), "Should be no error on Version")
+		return ver
+	}
+
+	It("Lists capabilities to clients which don't ask for any", func() {
+		config.EnableDeltaReceive = false
+		config.EnableDeltaSend = false
+		start()
+		ver := negotiate(&VersionRequest{})
+		Expect(ver.Capabilities).To(Equal([]string{"verification", "resume", "chunked", "framing", "compression", "locking"}), "Should list what's supported")
+		Expect(ver.Enabled).To(BeEmpty())
+
+		sendRawRequest(cli, "UploadStatus", &UploadStatusRequest{Oid: oid, Size: 7})
+		resp := readRawResponse(rdr, &UploadStatusResponse{})
+		Expect(resp.Error).To(BeNil(), "Everything should still be available without negotiation")
+	})
+
+	It("Only enables requested capabilities which are supported", func() {
+		start()
+		ver := negotiate(&VersionRequest{Capabilities: []string{"deltas", "teleport", "verification"}})
+		Expect(ver.Enabled).To(Equal([]string{"verification", "deltas"}), "Unknown capabilities should be ignored")
+		Expect(ver.Framing).To(BeEmpty(), "Shouldn't switch to framed mode unless asked")
+
+		sendRawRequest(cli, "UploadStatus", &UploadStatusRequest{Oid: oid, Size: 7})
+		resp := readRawResponse(rdr, nil)
+		Expect(resp.Error).To(ContainSubstring("needs the 'resume' capability"), "Methods for capabilities not enabled should be refused")
+
+		sendRawRequest(cli, "UploadCheck", &UploadStatusRequest{Oid: oid, Size: 7})
+		resp = readRawResponse(rdr, &UploadCheckResponse{})
+		Expect(resp.Error).To(BeNil(), "Core methods should always be available")
+
+		ver = negotiate(&VersionRequest{Capabilities: []string{"resume"}})
+		Expect(ver.Enabled).To(Equal([]string{"resume"}), "Capabilities can be renegotiated")
+		sendRawRequest(cli, "UploadStatus", &UploadStatusRequest{Oid: oid, Size: 7})
+		resp = readRawResponse(rdr, &UploadStatusResponse{})
+		Expect(resp.Error).To(BeNil())
+	})
+
+	It("Rejects Version requests with malformed params", func() {
+		start()
+		_, err := cli.Write(append([]byte(`{"id":1,"method":"Version","params":{"capabilities":"resume"}}`), 0))
+		Expect(err).To(BeNil())
+		resp := readRawResponse(rdr, nil)
+		Expect(resp.Error).ToNot(BeNil(), "Should be an error rather than ignoring the params")
+
+		ver := negotiate(&VersionRequest{Capabilities: []string{"resume"}})
+		Expect(ver.Enabled).To(Equal([]string{"resume"}), "Session should carry on after the error")
+	})
+
+	It("Switches to framed mode when framing is enabled", func() {
+		start()
+		ver := negotiate(&VersionRequest{Capabilities: []string{"framing"}})
+		Expect(ver.Enabled).To(Equal([]string{"framing"}))
+		Expect(ver.Framing).To(Equal(framingMultiplex))
+		mux := &frameMux{w: cli}
+		Expect(mux.writeFrame(frameJSON, 1, []byte(`{"id":1,"method":"Version","params":{"capabilities":["resume"]}}`))).To(Succeed())
+		ftype, id, payload, err := readFrame(rdr)
+		Expect(err).To(BeNil(), "Should get a framed response")
+		Expect(ftype).To(Equal(frameJSON))
+		Expect(id).To(Equal(1))
+		Expect(string(payload)).To(ContainSubstring(`"enabled":["framing"]`), "Capabilities can't change once framed")
+	})
+})
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// With the compression capability enabled, the binary content of an Upload or
+// a chunked Download can be sent compressed. Sizes & hashes always refer to the
+// uncompressed object.
+//
+// Upload params add "encoding" and "encodedSize"; the client then sends exactly
+// encodedSize bytes of compressed content.
+//
+// Download params add "encoding" (chunked downloads only); before the chunks the
+// server sends a JSON response saying which encoding it actually used, which is
+// none if a sample of the content didn't shrink enough to be worth it. The chunks
+// then carry the encoded stream and the trailer describes the uncompressed content.
+//
+// Only gzip is available; zstd would need a third party implementation.
+
+const encodingGzip = "gzip"
+
+// Encodings this server can send & receive, in order of preference
+var supportedEncodings = []string{encodingGzip}
+
+// How much content to compress when deciding whether compression is worthwhile
+const compressionSampleSize = 64 * 1024
+
+// Compress if the sample shrinks to this fraction of its size or less
+const compressionThreshold = 0.9
+
+// Sent before the chunks of a Download which asked for an encoding
+type DownloadStartResponse struct {
+	// Encoding of the chunked content, empty if it's not encoded
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func checkEncoding(encoding string) error {
+	for _, e := range supportedEncodings {
+		if e == encoding {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported encoding '%v'", encoding)
+}
+
+// Decide whether to send content compressed by compressing a sample from the
+// start of the range being sent. Returns the encoding to use, empty for none.
+func chooseEncoding(encoding string, store Store, path string, downreq *DownloadRangeRequest) string {
+	f, err := store.Open(path, downreq.Oid)
+	if err != nil {
+		// sendDownload will report it
+		return ""
+	}
+	defer f.Close()
+	sample := make([]byte, compressionSampleSize)
+	if downreq.Length > 0 && downreq.Length < int64(len(sample)) {
+		sample = sample[:downreq.Length]
+	}
+	n, err := f.ReadAt(sample, downreq.Offset)
+	if n == 0 {
+		return ""
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(sample[:n])
+	gz.Close()
+	ratio := float64(compressed.Len()) / float64(n)
+	logf("Download: sample of %v compresses to %.2f of its size\n", downreq.Oid, ratio)
+	if ratio > compressionThreshold {
+		return ""
+	}
+	return encoding
+}
+
+// Counts bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// Reads one encoded upload from in, which must be exactly encodedSize bytes.
+// Close consumes anything left over so the stream is in the right place for the
+// next request.
+type encodedReader struct {
+	encoded io.Reader
+	decoded io.Reader
+}
+
+func newEncodedReader(in io.Reader, encoding string, encodedSize int64) (*encodedReader, error) {
+	r := &encodedReader{encoded: io.LimitReader(in, encodedSize)}
+	gz, err := gzip.NewReader(r.encoded)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("Unable to decode %v content: %v", encoding, err.Error())
+	}
+	r.decoded = gz
+	return r, nil
+}
+
+func (r *encodedReader) Read(p []byte) (int, error) {
+	return r.decoded.Read(p)
+}
+
+func (r *encodedReader) Close() error {
+	_, err := io.Copy(ioutil.Discard, r.encoded)
+	return err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression", func() {
+
+	var config *Config
+	var repopath string
+	var cli net.Conn
+	var rdr *bufio.Reader
+	var done chan int
+	// Content which compresses well, and content which doesn't
+	var text, noise []byte
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+		text = bytes.Repeat([]byte("id,name,score\n1,alice,100\n2,bob,95\n"), 5000)
+		noise = make([]byte, 100000)
+		rand.New(rand.NewSource(42)).Read(noise)
+
+		var srv net.Conn
+		cli, srv = net.Pipe()
+		done = make(chan int, 1)
+		go func() {
+			done <- Serve(srv, srv, GinkgoWriter, config, repopath, nil)
+			srv.Close()
+		}()
+		rdr = bufio.NewReader(cli)
+	})
+	AfterEach(func() {
+		cli.Close()
+		<-done
+		os.RemoveAll(config.BasePath)
+	})
+
+	enable := func() {
+		sendRawRequest(cli, "Version", &VersionRequest{Capabilities: []string{"compression", "chunked"}})
+		ver := VersionResponse{}
+		readRawResponse(rdr, &ver)
+		Expect(ver.Enabled).To(ContainElement("compression"))
+		Expect(ver.Encodings).To(ContainElement("gzip"))
+	}
+	gzipped := func(content []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(content)
+		gz.Close()
+		return buf.Bytes()
+	}
+	uploadEncoded := func(content, encoded []byte) *lfs.JsonResponse {
+		sendRawRequest(cli, "Upload", &EncodedUploadRequest{Oid: oidFor(content), Size: int64(len(content)), Encoding: "gzip", EncodedSize: int64(len(encoded))})
+		start := lfs.UploadResponse{}
+		resp := readRawResponse(rdr, &start)
+		Expect(resp.Error).To(BeNil(), "Should be no error starting upload")
+		Expect(start.OkToSend).To(BeTrue())
+		_, err := cli.Write(encoded)
+		Expect(err).To(BeNil())
+		return readRawResponse(rdr, &lfs.UploadCompleteResponse{})
+	}
+
+	It("Receives compressed uploads", func() {
+		enable()
+		encoded := gzipped(text)
+		Expect(len(encoded)).To(BeNumerically("<", len(text)/10))
+		resp := uploadEncoded(text, encoded)
+		Expect(resp.Error).To(BeNil(), "Compressed upload should succeed")
+		filename, _ := mediaPath(oidFor(text), config, repopath)
+		stored, _ := ioutil.ReadFile(filename)
+		Expect(stored).To(Equal(text), "Content should be stored uncompressed")
+
+		other := []byte("not actually the content")
+		resp = uploadEncoded(other, []byte("this is not gzip data"))
+		Expect(resp.Error).To(ContainSubstring("Unable to decode gzip content"))
+
+		sendRawRequest(cli, "UploadCheck", &lfs.UploadRequest{Oid: oidFor(other), Size: int64(len(other))})
+		check := UploadCheckResponse{}
+		resp = readRawResponse(rdr, &check)
+		Expect(resp.Error).To(BeNil(), "Session should carry on after bad encoded content")
+		Expect(check.OkToSend).To(BeTrue())
+	})
+
+	It("Sends compressed downloads when worthwhile", func() {
+		enable()
+		Expect(uploadEncoded(text, gzipped(text)).Error).To(BeNil())
+		Expect(uploadEncoded(noise, gzipped(noise)).Error).To(BeNil())
+
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: oidFor(text), Size: int64(len(text)), Chunked: true, Encoding: "gzip"})
+		start := DownloadStartResponse{}
+		readRawResponse(rdr, &start)
+		Expect(start.Encoding).To(Equal("gzip"), "Compressible content should be compressed")
+		encoded := readRawChunks(rdr)
+		Expect(len(encoded)).To(BeNumerically("<", len(text)/10))
+		gz, err := gzip.NewReader(bytes.NewReader(encoded))
+		Expect(err).To(BeNil())
+		decoded, _ := ioutil.ReadAll(gz)
+		Expect(decoded).To(Equal(text))
+		trailer := DownloadTrailer{}
+		resp := readRawResponse(rdr, &trailer)
+		Expect(resp.Error).To(BeNil())
+		Expect(trailer.Size).To(BeEquivalentTo(len(text)), "Trailer should describe uncompressed content")
+		Expect(trailer.Sha256).To(Equal(oidFor(text)))
+
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: oidFor(noise), Size: int64(len(noise)), Chunked: true, Encoding: "gzip"})
+		start = DownloadStartResponse{}
+		readRawResponse(rdr, &start)
+		Expect(start.Encoding).To(BeEmpty(), "Content which doesn't compress should be sent as is")
+		Expect(readRawChunks(rdr)).To(Equal(noise))
+		resp = readRawResponse(rdr, &trailer)
+		Expect(resp.Error).To(BeNil())
+	})
+
+	It("Refuses compression unless it's enabled", func() {
+		sendRawRequest(cli, "Version", &VersionRequest{Capabilities: []string{"chunked"}})
+		readRawResponse(rdr, nil)
+		sendRawRequest(cli, "Upload", &EncodedUploadRequest{Oid: oidFor(text), Size: int64(len(text)), Encoding: "gzip", EncodedSize: 10})
+		resp := readRawResponse(rdr, nil)
+		Expect(resp.Error).To(ContainSubstring("'compression' capability"))
+	})
+})
@@ -12,30 +12,61 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// NOTE: there are some configuration options in here for binary delta support
-// these are not currently implemented in this server but are reserved for future use
-
 type Config struct {
-	BasePath           string
-	AllowAbsolutePaths bool
-	EnableDeltaReceive bool
-	EnableDeltaSend    bool
-	DeltaCachePath     string
-	DeltaSizeLimit     int64
-	LogFile            string
-	DebugLog           bool
+	BasePath            string
+	Store               string
+	S3Bucket            string
+	S3Endpoint          string
+	S3Region            string
+	S3AccessKey         string
+	S3SecretKey         string
+	S3Prefix            string
+	AllowAbsolutePaths  bool
+	EnableDeltaReceive  bool
+	EnableDeltaSend     bool
+	DeltaCachePath      string
+	DeltaSizeLimit      int64
+	StagingPath         string
+	PartialUploadExpiry time.Duration
+	UploadLockTimeout   time.Duration
+	GCRetention         time.Duration
+	GCGracePeriod       time.Duration
+	QuarantinePath      string
+	LogFile             string
+	DebugLog            bool
+	AccessRules         []*AccessRule
+	Quotas              []*Quota
+	QuotaCacheExpiry    time.Duration
+	AuthSecret          string
+	AuthTokenExpiry     time.Duration
+	HTTPURL             string
+	HTTPListen          string
+	Groups              map[string][]string
 }
 
 const defaultDeltaSizeLimit int64 = 2 * 1024 * 1024 * 1024
+const defaultPartialUploadExpiry = 7 * 24 * time.Hour
+const defaultUploadLockTimeout = 30 * time.Second
+const defaultGCGracePeriod = 24 * time.Hour
+const defaultQuotaCacheExpiry = time.Hour
+const defaultAuthTokenExpiry = 15 * time.Minute
+const defaultHTTPListen = ":8080"
 
 func NewConfig() *Config {
 	return &Config{
-		AllowAbsolutePaths: false,
-		EnableDeltaReceive: true,
-		EnableDeltaSend:    true,
-		DeltaSizeLimit:     defaultDeltaSizeLimit, // 2GB
+		AllowAbsolutePaths:  false,
+		EnableDeltaReceive:  true,
+		EnableDeltaSend:     true,
+		DeltaSizeLimit:      defaultDeltaSizeLimit,      // 2GB
+		PartialUploadExpiry: defaultPartialUploadExpiry, // 1 week
+		UploadLockTimeout:   defaultUploadLockTimeout,
+		GCGracePeriod:       defaultGCGracePeriod,
+		QuotaCacheExpiry:    defaultQuotaCacheExpiry,
+		AuthTokenExpiry:     defaultAuthTokenExpiry,
+		HTTPListen:          defaultHTTPListen,
 	}
 }
 func LoadConfig() *Config {
@@ -50,7 +81,7 @@ func LoadConfig() *Config {
 	var configFiles []string
 	home, herr := homedir.Dir()
 	if herr != nil {
-		fmt.Fprint(os.Stderr, "Warning, couldn't locate home directory: %v", herr.Error())
+		fmt.Fprintf(os.Stderr, "Warning, couldn't locate home directory: %v\n", herr.Error())
 	}
 
 	// Order is important; read global config files first then user config files so settings
@@ -85,6 +116,15 @@ func LoadConfig() *Config {
 	if v := settings["base-path"]; v != "" {
 		cfg.BasePath = filepath.Clean(v)
 	}
+	if v := settings["store"]; v != "" {
+		cfg.Store = v
+	}
+	cfg.S3Bucket = settings["s3.bucket"]
+	cfg.S3Endpoint = settings["s3.endpoint"]
+	cfg.S3Region = settings["s3.region"]
+	cfg.S3AccessKey = settings["s3.access-key"]
+	cfg.S3SecretKey = settings["s3.secret-key"]
+	cfg.S3Prefix = settings["s3.prefix"]
 	if v := strings.ToLower(settings["allow-absolute-paths"]); v != "" {
 		if v == "true" {
 			cfg.AllowAbsolutePaths = true
@@ -122,6 +162,65 @@ func LoadConfig() *Config {
 			cfg.DeltaSizeLimit = defaultDeltaSizeLimit
 		}
 	}
+	if v := settings["staging-path"]; v != "" {
+		cfg.StagingPath = filepath.Clean(v)
+	}
+	if v := settings["partial-upload-expiry"]; v != "" {
+		var err error
+		cfg.PartialUploadExpiry, err = time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: partial-upload-expiry=%v\n", v)
+			cfg.PartialUploadExpiry = defaultPartialUploadExpiry
+		}
+	}
+	if v := settings["upload-lock-timeout"]; v != "" {
+		var err error
+		cfg.UploadLockTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: upload-lock-timeout=%v\n", v)
+			cfg.UploadLockTimeout = defaultUploadLockTimeout
+		}
+	}
+	if v := settings["gc-retention"]; v != "" {
+		var err error
+		cfg.GCRetention, err = time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: gc-retention=%v\n", v)
+			cfg.GCRetention = 0
+		}
+	}
+	if v := settings["gc-grace-period"]; v != "" {
+		var err error
+		cfg.GCGracePeriod, err = time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: gc-grace-period=%v\n", v)
+			cfg.GCGracePeriod = defaultGCGracePeriod
+		}
+	}
+	if v := settings["quarantine-path"]; v != "" {
+		cfg.QuarantinePath = filepath.Clean(v)
+	}
+	if v := settings["quota-cache-expiry"]; v != "" {
+		var err error
+		cfg.QuotaCacheExpiry, err = time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: quota-cache-expiry=%v\n", v)
+			cfg.QuotaCacheExpiry = defaultQuotaCacheExpiry
+		}
+	}
+	cfg.AuthSecret = settings["auth-secret"]
+	if v := settings["auth-token-expiry"]; v != "" {
+		var err error
+		cfg.AuthTokenExpiry, err = time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: auth-token-expiry=%v\n", v)
+			cfg.AuthTokenExpiry = defaultAuthTokenExpiry
+		}
+	}
+	cfg.HTTPURL = settings["http-url"]
+	if v := settings["http-listen"]; v != "" {
+		cfg.HTTPListen = v
+	}
 	if v := settings["log-file"]; v != "" {
 		cfg.LogFile = v
 	}
@@ -133,6 +232,9 @@ func LoadConfig() *Config {
 		}
 	}
 
+	parseAccessSettings(settings, cfg)
+	parseQuotaSettings(settings, cfg)
+
 	return cfg
 }
 
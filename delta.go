@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Binary deltas are a simple copy/insert instruction stream in the style of xdelta:
+//
+//   "LFSD" <version byte>
+//   then any number of instructions, each starting with an opcode byte:
+//     deltaOpCopy   <uvarint offset> <uvarint length>  copy bytes from the base object
+//     deltaOpInsert <uvarint length> <bytes>           insert literal bytes
+//   and finally deltaOpEnd
+//
+// Applying a delta only needs random access to the base and writes the result
+// sequentially, so objects never need to be held in memory.
+
+const (
+	deltaMagic   = "LFSD"
+	deltaVersion = byte(1)
+
+	deltaOpEnd    = byte(0)
+	deltaOpCopy   = byte(1)
+	deltaOpInsert = byte(2)
+)
+
+// A delta is only sent if it's smaller than this fraction of the full object
+const deltaUsefulRatio = 0.75
+
+// DownloadDelta tries at most this many of the bases a client offers, since each
+// one means reading both objects through
+const deltaMaxBases = 4
+
+// Literal runs are flushed to the delta once they get this big
+const deltaMaxLiteral = 1024 * 1024
+
+type UploadDeltaRequest struct {
+	// Oid & size of the final object
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+	// Object the client believes the server has, which the delta applies to
+	BaseOid string `json:"baseOid"`
+	// Number of bytes of delta data which follow
+	DeltaSize int64 `json:"deltaSize"`
+}
+
+type DownloadDeltaRequest struct {
+	Oid string `json:"oid"`
+	// Objects the client already has, any of which may be used as the base; only
+	// the first few which are stored on the server are tried, so list the best first
+	BaseOids []string `json:"baseOids"`
+}
+type DownloadDeltaResponse struct {
+	// Size of the final object
+	Size int64 `json:"size"`
+	// Object the delta which follows applies to; blank if no useful delta was
+	// available and the full content follows instead
+	BaseOid string `json:"baseOid"`
+	// Number of bytes which follow this response
+	DeltaSize int64 `json:"deltaSize"`
+}
+
+// Writes a binary delta to an underlying stream
+type deltaWriter struct {
+	w       *bufio.Writer
+	started bool
+	buf     [binary.MaxVarintLen64]byte
+}
+
+func newDeltaWriter(w io.Writer) *deltaWriter {
+	return &deltaWriter{w: bufio.NewWriter(w)}
+}
+
+func (d *deltaWriter) writeHeader() error {
+	if d.started {
+		return nil
+	}
+	d.started = true
+	_, err := d.w.WriteString(deltaMagic)
+	if err != nil {
+		return err
+	}
+	return d.w.WriteByte(deltaVersion)
+}
+
+func (d *deltaWriter) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(d.buf[:], v)
+	_, err := d.w.Write(d.buf[:n])
+	return err
+}
+
+// Copy length bytes from offset in the base object
+func (d *deltaWriter) Copy(offset, length int64) error {
+	if err := d.writeHeader(); err != nil {
+		return err
+	}
+	if err := d.w.WriteByte(deltaOpCopy); err != nil {
+		return err
+	}
+	if err := d.writeUvarint(uint64(offset)); err != nil {
+		return err
+	}
+	return d.writeUvarint(uint64(length))
+}
+
+// Insert literal data
+func (d *deltaWriter) Insert(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := d.writeHeader(); err != nil {
+		return err
+	}
+	if err := d.w.WriteByte(deltaOpInsert); err != nil {
+		return err
+	}
+	if err := d.writeUvarint(uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := d.w.Write(data)
+	return err
+}
+
+// Terminate the delta & flush; doesn't close the underlying stream
+func (d *deltaWriter) Close() error {
+	if err := d.writeHeader(); err != nil {
+		return err
+	}
+	if err := d.w.WriteByte(deltaOpEnd); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// Apply a delta read from the delta stream to base, writing the result to out
+// Returns the number of bytes written to out
+func applyDelta(base io.ReaderAt, baseSize int64, delta *bufio.Reader, out io.Writer) (int64, error) {
+	var written int64
+	for _, c := range []byte(deltaMagic) {
+		b, err := delta.ReadByte()
+		if err != nil || b != c {
+			return 0, errors.New("Delta data has an invalid header")
+		}
+	}
+	ver, err := delta.ReadByte()
+	if err != nil {
+		return 0, errors.New("Delta data has an invalid header")
+	}
+	if ver != deltaVersion {
+		return 0, fmt.Errorf("Unsupported delta version %d", ver)
+	}
+
+	for {
+		op, err := delta.ReadByte()
+		if err != nil {
+			return written, fmt.Errorf("Delta data ended unexpectedly: %v", err)
+		}
+		switch op {
+		case deltaOpEnd:
+			return written, nil
+		case deltaOpCopy:
+			offset, err := binary.ReadUvarint(delta)
+			if err != nil {
+				return written, fmt.Errorf("Invalid copy instruction in delta: %v", err)
+			}
+			length, err := binary.ReadUvarint(delta)
+			if err != nil {
+				return written, fmt.Errorf("Invalid copy instruction in delta: %v", err)
+			}
+			if offset > uint64(baseSize) || length > uint64(baseSize)-offset {
+				return written, fmt.Errorf("Delta copies outside of base object (offset %d length %d base size %d)", offset, length, baseSize)
+			}
+			n, err := io.Copy(out, io.NewSectionReader(base, int64(offset), int64(length)))
+			written += n
+			if err != nil {
+				return written, err
+			}
+		case deltaOpInsert:
+			length, err := binary.ReadUvarint(delta)
+			if err != nil {
+				return written, fmt.Errorf("Invalid insert instruction in delta: %v", err)
+			}
+			n, err := io.CopyN(out, delta, int64(length))
+			written += n
+			if err != nil {
+				return written, fmt.Errorf("Delta data ended unexpectedly: %v", err)
+			}
+		default:
+			return written, fmt.Errorf("Unknown delta instruction %d", op)
+		}
+	}
+}
+
+// Writes to w until more than limit bytes in total would be written, then fails
+type sizeLimitWriter struct {
+	w       io.Writer
+	limit   int64
+	written int64
+}
+
+func (l *sizeLimitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.limit-l.written {
+		return 0, fmt.Errorf("Delta produces more than the expected %d bytes", l.limit)
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+// Pick a block size for matching so that the index of the base stays a sensible size
+func deltaBlockSize(baseSize int64) int {
+	bs := int64(64)
+	for baseSize/bs > 1024*1024 {
+		bs *= 2
+	}
+	return int(bs)
+}
+
+// rsync-style rolling checksum over a window of bytes
+type rollingHash struct {
+	a, b uint32
+	n    uint32
+}
+
+func (h *rollingHash) init(window []byte) {
+	h.a, h.b = 0, 0
+	h.n = uint32(len(window))
+	for i, c := range window {
+		h.a += uint32(c)
+		h.b += (h.n - uint32(i)) * uint32(c)
+	}
+}
+
+func (h *rollingHash) roll(out, in byte) {
+	h.a = h.a - uint32(out) + uint32(in)
+	h.b = h.b - h.n*uint32(out) + h.a
+}
+
+func (h *rollingHash) sum() uint32 {
+	return (h.a & 0xffff) | (h.b << 16)
+}
+
+// Compute a delta which turns base into target, writing it to out
+// The base is indexed in blocks and only the index is held in memory; target is
+// read sequentially
+func computeDelta(base io.ReaderAt, baseSize int64, target io.Reader, out io.Writer) error {
+	bs := deltaBlockSize(baseSize)
+	index := make(map[uint32]int64, baseSize/int64(bs))
+	block := make([]byte, bs)
+	var h rollingHash
+	for off := int64(0); off+int64(bs) <= baseSize; off += int64(bs) {
+		if _, err := base.ReadAt(block, off); err != nil {
+			return err
+		}
+		h.init(block)
+		if _, exists := index[h.sum()]; !exists {
+			index[h.sum()] = off
+		}
+	}
+
+	d := newDeltaWriter(out)
+	tr := bufio.NewReader(target)
+	// Bytes not yet matched against the base; the last bs of them are the window
+	// currently being checked for a match
+	literal := make([]byte, 0, bs*2)
+	for {
+		c, err := tr.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		literal = append(literal, c)
+		if len(literal) < bs {
+			continue
+		} else if len(literal) == bs {
+			h.init(literal)
+		} else {
+			h.roll(literal[len(literal)-bs-1], c)
+		}
+
+		window := literal[len(literal)-bs:]
+		off, found := index[h.sum()]
+		if found {
+			// Weak hash matched, confirm the block really is the same
+			if _, err := base.ReadAt(block, off); err != nil {
+				return err
+			}
+			found = bytes.Equal(block, window)
+		}
+		if !found {
+			if len(literal) >= deltaMaxLiteral {
+				if err := d.Insert(literal[:len(literal)-bs]); err != nil {
+					return err
+				}
+				literal = append(literal[:0], window...)
+			}
+			continue
+		}
+
+		if err := d.Insert(literal[:len(literal)-bs]); err != nil {
+			return err
+		}
+		// Extend the match as far as it goes
+		matchlen := int64(bs)
+		baserdr := bufio.NewReader(io.NewSectionReader(base, off+matchlen, baseSize-off-matchlen))
+		for {
+			bc, err := baserdr.ReadByte()
+			if err != nil {
+				break
+			}
+			tc, err := tr.ReadByte()
+			if err != nil {
+				break
+			}
+			if tc != bc {
+				tr.UnreadByte()
+				break
+			}
+			matchlen++
+		}
+		if err := d.Copy(off, matchlen); err != nil {
+			return err
+		}
+		literal = literal[:0]
+	}
+	if err := d.Insert(literal); err != nil {
+		return err
+	}
+	return d.Close()
+}
+
+func uploadDelta(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	upreq := UploadDeltaRequest{}
+	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &upreq)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	logf("UploadDelta %d: requested %v %d from base %v (delta %d)\n", req.Id, upreq.Oid, upreq.Size, upreq.BaseOid, upreq.DeltaSize)
+	if !config.EnableDeltaReceive {
+		return lfs.NewJsonErrorResponse(req.Id, "Delta uploads are disabled on this server")
+	}
+	if upreq.Size > config.DeltaSizeLimit {
+		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Object size %d exceeds the delta size limit of %d", upreq.Size, config.DeltaSizeLimit))
+	}
+	if upreq.DeltaSize < 0 || upreq.DeltaSize > upreq.Size {
+		// A client should send the object itself rather than a bigger delta
+		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Invalid delta size %d for object size %d", upreq.DeltaSize, upreq.Size))
+	}
+	if resp := invalidOidResponse(req.Id, upreq.Oid, upreq.BaseOid); resp != nil {
+		return resp
+	}
+	startresult := lfs.UploadResponse{}
+	stored, staterr := sess.Store.Size(path, upreq.Oid)
+	if staterr == nil && stored != upreq.Size {
+		return sizeConflictResponse(req.Id, upreq.Oid, stored, upreq.Size)
+	}
+	if staterr != nil && os.IsNotExist(staterr) {
+		if err := checkQuota(config, sess.Store, sess.User, path, upreq.Size); err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+		lock, exists, err := lockUpload(upreq.Oid, sess.Store, config, path, false)
+		if err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+		if lock != nil {
+			defer lock.release()
+		}
+		startresult.OkToSend = !exists
+	}
+	var basef ObjectReader
+	var basesize int64
+	if startresult.OkToSend {
+		// Base must exist for the delta to be any use; check this before the client sends it
+		basesize, err = sess.Store.Size(path, upreq.BaseOid)
+		if err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Base object %v is not available", upreq.BaseOid))
+		}
+		if basesize > config.DeltaSizeLimit {
+			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Base object size %d exceeds the delta size limit of %d", basesize, config.DeltaSizeLimit))
+		}
+		basef, err = openDeltaBase(sess.Store, config, path, upreq.BaseOid)
+		if err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Base object %v is not available", upreq.BaseOid))
+		}
+		defer basef.Close()
+	}
+	// Send start response immediately
+	resp, err := lfs.NewJsonResponse(req.Id, startresult)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	err = sendResponse(resp, out)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	if !startresult.OkToSend {
+		logf("UploadDelta %d: content already exists for %v\n", req.Id, upreq.Oid)
+		return nil
+	}
+
+	logf("UploadDelta %d: waiting for delta for %v\n", req.Id, upreq.Oid)
+	// Next from client is exactly DeltaSize bytes of delta, which we apply as it arrives
+	tempf, err := stagingTempFile(config, path, "tempupload")
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unable to create temp file: %v", err.Error()))
+	}
+	defer os.Remove(tempf.Name())
+	defer tempf.Close()
+	hasher := sha256.New()
+	deltain := io.LimitReader(in, upreq.DeltaSize)
+	// Copies can repeat, so stop as soon as the delta produces more than it should
+	limited := &sizeLimitWriter{w: io.MultiWriter(tempf, hasher), limit: upreq.Size}
+	n, applyerr := applyDelta(basef, basesize, bufio.NewReader(deltain), limited)
+	// Always consume the whole delta so the stream is left in the right place for the next request
+	io.Copy(ioutil.Discard, deltain)
+
+	receivedresult := lfs.UploadCompleteResponse{}
+	receivedresult.ReceivedOk = true
+	var receiveerr string
+	if applyerr != nil {
+		receiveerr = fmt.Sprintf("Unable to apply delta: %v", applyerr.Error())
+	} else if n != upreq.Size {
+		receiveerr = fmt.Sprintf("Delta produced wrong number of bytes %d (expected %d)", n, upreq.Size)
+	} else {
+		err = commitUpload(tempf, hasher, upreq.Oid, sess.Store, path)
+		if err != nil {
+			receiveerr = err.Error()
+		}
+	}
+
+	if receiveerr != "" {
+		receivedresult.ReceivedOk = false
+	}
+	resp, _ = lfs.NewJsonResponse(req.Id, receivedresult)
+	if receiveerr != "" {
+		logf("UploadDelta %d: error in content for %v: %v\n", req.Id, upreq.Oid, receiveerr)
+		resp.Error = receiveerr
+	} else {
+		logf("UploadDelta %d: content for %v received\n", req.Id, upreq.Oid)
+		recordUpload(config, sess.User, path, upreq.Oid, upreq.Size)
+	}
+
+	return resp
+}
+
+// A base object copied to a local temp file, which is removed on Close
+type spooledObject struct {
+	*os.File
+}
+
+func (s *spooledObject) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	return err
+}
+
+// Open an object to use as the base of a delta. Deltas read the base a block at
+// a time at any offset, which for stores other than the filesystem would mean a
+// request per block, so the base is copied to a local file first.
+func openDeltaBase(store Store, config *Config, path, oid string) (ObjectReader, error) {
+	f, err := store.Open(path, oid)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := store.(*fsStore); ok {
+		return f, nil
+	}
+	defer f.Close()
+	tempf, err := stagingTempFile(config, path, "tempbase")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledObject{tempf}
+	if _, err = io.Copy(tempf, f); err == nil {
+		_, err = tempf.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, fmt.Errorf("Unable to copy base object %v: %v", oid, err.Error())
+	}
+	return spooled, nil
+}
+
+// Find or create a delta from baseoid to oid, returning the filename of the delta.
+// Deltas are kept in DeltaCachePath for re-use if it's set, if not the caller
+// must remove the returned file once it's finished with it
+func deltaFile(baseoid, oid string, store Store, config *Config, path string) (string, error) {
+	var cachefile string
+	if config.DeltaCachePath != "" {
+		cachefile = filepath.Join(config.DeltaCachePath, path, fmt.Sprintf("%v-%v", baseoid, oid))
+		if _, err := os.Stat(cachefile); err == nil {
+			return cachefile, nil
+		}
+		if err := ensureDirExists(filepath.Dir(cachefile), config); err != nil {
+			return "", err
+		}
+	}
+
+	basesize, err := store.Size(path, baseoid)
+	if err != nil {
+		return "", err
+	}
+	if basesize > config.DeltaSizeLimit {
+		return "", fmt.Errorf("Base object %v is too large for deltas", baseoid)
+	}
+	basef, err := openDeltaBase(store, config, path, baseoid)
+	if err != nil {
+		return "", err
+	}
+	defer basef.Close()
+	f, err := store.Open(path, oid)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Write to a temp file first so the cache never has a partial delta in it
+	tempdir := ""
+	if cachefile != "" {
+		tempdir = filepath.Dir(cachefile)
+	}
+	tempf, err := ioutil.TempFile(tempdir, "tempdelta")
+	if err != nil {
+		return "", err
+	}
+	err = computeDelta(basef, basesize, f, tempf)
+	if err == nil {
+		err = tempf.Close()
+	}
+	if err != nil {
+		tempf.Close()
+		os.Remove(tempf.Name())
+		return "", err
+	}
+	if cachefile == "" {
+		return tempf.Name(), nil
+	}
+	err = os.Rename(tempf.Name(), cachefile)
+	if err != nil {
+		os.Remove(tempf.Name())
+		return "", err
+	}
+	return cachefile, nil
+}
+
+func downloadDelta(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	downreq := DownloadDeltaRequest{}
+	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &downreq)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	logf("DownloadDelta %d: %v requested with %d possible bases\n", req.Id, downreq.Oid, len(downreq.BaseOids))
+	if resp := invalidOidResponse(req.Id, downreq.Oid); resp != nil {
+		return resp
+	}
+	size, err := sess.Store.Size(path, downreq.Oid)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, "File doesn't exist")
+	}
+
+	result := DownloadDeltaResponse{Size: size, DeltaSize: size}
+	sendfilename := ""
+	if config.EnableDeltaSend && size <= config.DeltaSizeLimit {
+		// Use whichever base gives the smallest delta
+		tried := 0
+		for _, baseoid := range downreq.BaseOids {
+			if tried >= deltaMaxBases {
+				break
+			}
+			// bases are only hints so just ignore any invalid ones
+			if baseoid == downreq.Oid || !validOid(baseoid) {
+				continue
+			}
+			basesize, err := sess.Store.Size(path, baseoid)
+			if err != nil || basesize > config.DeltaSizeLimit {
+				continue
+			}
+			tried++
+			dfilename, err := deltaFile(baseoid, downreq.Oid, sess.Store, config, path)
+			if err != nil {
+				debugf("DownloadDelta %d: no delta from %v: %v\n", req.Id, baseoid, err)
+				continue
+			}
+			if config.DeltaCachePath == "" {
+				defer os.Remove(dfilename)
+			}
+			ds, err := os.Stat(dfilename)
+			if err != nil {
+				continue
+			}
+			if ds.Size() < result.DeltaSize && float64(ds.Size()) < float64(size)*deltaUsefulRatio {
+				result.BaseOid = baseoid
+				result.DeltaSize = ds.Size()
+				sendfilename = dfilename
+			}
+		}
+	}
+
+	var f io.ReadCloser
+	if sendfilename != "" {
+		f, err = os.OpenFile(sendfilename, os.O_RDONLY, 0644)
+	} else {
+		f, err = sess.Store.Open(path, downreq.Oid)
+	}
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	defer f.Close()
+
+	if result.BaseOid != "" {
+		logf("DownloadDelta %d: sending delta for %v from %v (%d bytes instead of %d)\n", req.Id, downreq.Oid, result.BaseOid, result.DeltaSize, result.Size)
+	} else {
+		logf("DownloadDelta %d: no useful delta, sending full content for %v\n", req.Id, downreq.Oid)
+	}
+	resp, err := lfs.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	err = sendResponse(resp, out)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+
+	// From here on the client is expecting raw bytes so errors can't be sent as JSON
+	n, err := io.Copy(out, f)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, streamFailure(fmt.Sprintf("Error copying data to output: %v", err.Error())))
+	}
+	if n != result.DeltaSize {
+		return lfs.NewJsonErrorResponse(req.Id, streamFailure(fmt.Sprintf("Amount of data copied disagrees (expected: %d actual: %d)", result.DeltaSize, n)))
+	}
+	logf("DownloadDelta %d: successfully sent content for %v\n", req.Id, downreq.Oid)
+	return nil
+}
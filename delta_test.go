@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Binary deltas", func() {
+
+	var base []byte
+	var target []byte
+
+	BeforeEach(func() {
+		base = make([]byte, 4000)
+		for i := range base {
+			base[i] = byte(i * 7)
+		}
+		// target is base with a changed section in the middle and some extra on the end
+		target = make([]byte, 0, 5000)
+		target = append(target, base[:1500]...)
+		target = append(target, []byte("this part of the file has changed")...)
+		target = append(target, base[2000:]...)
+		target = append(target, []byte("and this is new")...)
+	})
+
+	writeTestDelta := func() []byte {
+		var buf bytes.Buffer
+		d := newDeltaWriter(&buf)
+		Expect(d.Copy(0, 1500)).To(Succeed())
+		Expect(d.Insert([]byte("this part of the file has changed"))).To(Succeed())
+		Expect(d.Copy(2000, 2000)).To(Succeed())
+		Expect(d.Insert([]byte("and this is new"))).To(Succeed())
+		Expect(d.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	It("Applies deltas", func() {
+		delta := writeTestDelta()
+		var out bytes.Buffer
+		n, err := applyDelta(bytes.NewReader(base), int64(len(base)), bufio.NewReader(bytes.NewReader(delta)), &out)
+		Expect(err).To(BeNil(), "Should be no error applying delta")
+		Expect(n).To(BeEquivalentTo(len(target)), "Should report the number of bytes written")
+		Expect(out.Bytes()).To(Equal(target), "Delta should rebuild the target")
+	})
+
+	It("Rejects invalid deltas", func() {
+		var out bytes.Buffer
+		_, err := applyDelta(bytes.NewReader(base), int64(len(base)), bufio.NewReader(bytes.NewReader([]byte("BSDIFF40"))), &out)
+		Expect(err).ToNot(BeNil(), "Should reject data without a delta header")
+
+		var buf bytes.Buffer
+		d := newDeltaWriter(&buf)
+		d.Copy(3000, 2000)
+		d.Close()
+		_, err = applyDelta(bytes.NewReader(base), int64(len(base)), bufio.NewReader(&buf), &out)
+		Expect(err).ToNot(BeNil(), "Should reject copies from outside the base")
+
+		delta := writeTestDelta()
+		_, err = applyDelta(bytes.NewReader(base), int64(len(base)), bufio.NewReader(bytes.NewReader(delta[:len(delta)-10])), &out)
+		Expect(err).ToNot(BeNil(), "Should reject truncated deltas")
+	})
+
+	It("Computes deltas", func() {
+		var delta bytes.Buffer
+		err := computeDelta(bytes.NewReader(base), int64(len(base)), bytes.NewReader(target), &delta)
+		Expect(err).To(BeNil(), "Should be no error computing delta")
+		Expect(delta.Len()).To(BeNumerically("<", len(target)/4), "Delta should be much smaller than the target")
+		var out bytes.Buffer
+		_, err = applyDelta(bytes.NewReader(base), int64(len(base)), bufio.NewReader(&delta), &out)
+		Expect(err).To(BeNil(), "Should be no error applying computed delta")
+		Expect(out.Bytes()).To(Equal(target), "Computed delta should rebuild the target")
+
+		// Completely unrelated content still round trips
+		delta.Reset()
+		out.Reset()
+		unrelated := []byte("nothing in common with the base at all")
+		err = computeDelta(bytes.NewReader(base), int64(len(base)), bytes.NewReader(unrelated), &delta)
+		Expect(err).To(BeNil(), "Should be no error computing delta")
+		_, err = applyDelta(bytes.NewReader(base), int64(len(base)), bufio.NewReader(&delta), &out)
+		Expect(err).To(BeNil(), "Should be no error applying computed delta")
+		Expect(out.Bytes()).To(Equal(unrelated), "Computed delta should rebuild the target")
+	})
+
+	Context("Over SSH", func() {
+		var config *Config
+		var repopath string
+
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+			os.MkdirAll(config.BasePath, 0755)
+			repopath = "test/repo"
+		})
+		AfterEach(func() {
+			os.RemoveAll(config.BasePath)
+		})
+
+		It("Rebuilds uploaded objects from deltas", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath, nil)
+			defer cli.Close()
+			ctx := lfs.NewManualSSHApiContext(cli, cli)
+			rdr := bufio.NewReader(cli)
+
+			baseoid := oidFor(base)
+			targetoid := oidFor(target)
+			obj, wrerr := ctx.UploadCheck(baseoid, int64(len(base)))
+			Expect(wrerr).To(BeNil(), "Should be no error on UploadCheck")
+			wrerr = ctx.UploadObject(obj, bytes.NewReader(base))
+			Expect(wrerr).To(BeNil(), "Should be no error uploading base")
+
+			delta := writeTestDelta()
+			sendRawRequest(cli, "UploadDelta", &UploadDeltaRequest{targetoid, int64(len(target)), baseoid, int64(len(delta))})
+			startresp := lfs.UploadResponse{}
+			resp := readRawResponse(rdr, &startresp)
+			Expect(resp.Error).To(BeNil(), "Should be no error starting delta upload")
+			Expect(startresp.OkToSend).To(BeTrue(), "Server should want the delta")
+			cli.Write(delta)
+			completeresp := lfs.UploadCompleteResponse{}
+			resp = readRawResponse(rdr, &completeresp)
+			Expect(resp.Error).To(BeNil(), "Should be no error applying delta")
+			Expect(completeresp.ReceivedOk).To(BeTrue(), "Delta should be received OK")
+
+			filename, _ := mediaPath(targetoid, config, repopath)
+			stored, err := ioutil.ReadFile(filename)
+			Expect(err).To(BeNil(), "Rebuilt object should be in the store")
+			Expect(stored).To(Equal(target), "Rebuilt object should have the correct content")
+
+			// A delta which doesn't produce the content the oid says is rejected
+			wrongoid := oidFor([]byte("something else"))
+			sendRawRequest(cli, "UploadDelta", &UploadDeltaRequest{wrongoid, int64(len(target)), baseoid, int64(len(delta))})
+			resp = readRawResponse(rdr, &startresp)
+			Expect(startresp.OkToSend).To(BeTrue(), "Server should want the delta")
+			cli.Write(delta)
+			resp = readRawResponse(rdr, nil)
+			Expect(resp.Error).ToNot(BeNil(), "Should be an error when delta result fails verification")
+			filename, _ = mediaPath(wrongoid, config, repopath)
+			_, err = os.Stat(filename)
+			Expect(os.IsNotExist(err)).To(BeTrue(), "Unverified object should not be stored")
+
+			// Base which the server doesn't have is refused before the delta is sent
+			sendRawRequest(cli, "UploadDelta", &UploadDeltaRequest{wrongoid, int64(len(target)), wrongoid, int64(len(delta))})
+			resp = readRawResponse(rdr, nil)
+			Expect(resp.Error).ToNot(BeNil(), "Should be an error when base is missing")
+
+			// Repeated copies can't produce more than the object size
+			var bomb bytes.Buffer
+			d := newDeltaWriter(&bomb)
+			for i := 0; i < 100; i++ {
+				d.Copy(0, int64(len(base)))
+			}
+			d.Close()
+			sendRawRequest(cli, "UploadDelta", &UploadDeltaRequest{wrongoid, int64(len(target)), baseoid, int64(bomb.Len())})
+			resp = readRawResponse(rdr, &startresp)
+			Expect(startresp.OkToSend).To(BeTrue(), "Server should want the delta")
+			cli.Write(bomb.Bytes())
+			resp = readRawResponse(rdr, nil)
+			Expect(resp.Error).To(ContainSubstring("more than the expected"), "Delta output should be limited to the object size")
+
+			// Deltas bigger than the object are refused before being sent
+			sendRawRequest(cli, "UploadDelta", &UploadDeltaRequest{wrongoid, 10, baseoid, 20})
+			resp = readRawResponse(rdr, nil)
+			Expect(resp.Error).To(ContainSubstring("Invalid delta size"))
+
+			ctx.Close()
+		})
+
+		It("Sends deltas for downloads", func() {
+			config.DeltaCachePath = filepath.Join(config.BasePath, ".deltacache")
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath, nil)
+			defer cli.Close()
+			ctx := lfs.NewManualSSHApiContext(cli, cli)
+			rdr := bufio.NewReader(cli)
+
+			baseoid := oidFor(base)
+			targetoid := oidFor(target)
+			for _, content := range [][]byte{base, target} {
+				obj, wrerr := ctx.UploadCheck(oidFor(content), int64(len(content)))
+				Expect(wrerr).To(BeNil(), "Should be no error on UploadCheck")
+				wrerr = ctx.UploadObject(obj, bytes.NewReader(content))
+				Expect(wrerr).To(BeNil(), "Should be no error on upload")
+			}
+
+			for i := 0; i < 2; i++ {
+				// Second time around should use the cached delta
+				sendRawRequest(cli, "DownloadDelta", &DownloadDeltaRequest{targetoid, []string{oidFor([]byte("missing")), baseoid}})
+				result := DownloadDeltaResponse{}
+				resp := readRawResponse(rdr, &result)
+				Expect(resp.Error).To(BeNil(), "Should be no error on DownloadDelta")
+				Expect(result.Size).To(BeEquivalentTo(len(target)), "Should report the size of the object")
+				Expect(result.BaseOid).To(Equal(baseoid), "Should use the base the server has")
+				Expect(result.DeltaSize).To(BeNumerically("<", len(target)), "Delta should be smaller than the object")
+				delta := make([]byte, result.DeltaSize)
+				_, err := io.ReadFull(rdr, delta)
+				Expect(err).To(BeNil(), "Should be able to read delta")
+				var out bytes.Buffer
+				_, err = applyDelta(bytes.NewReader(base), int64(len(base)), bufio.NewReader(bytes.NewReader(delta)), &out)
+				Expect(err).To(BeNil(), "Should be no error applying downloaded delta")
+				Expect(out.Bytes()).To(Equal(target), "Downloaded delta should rebuild the target")
+			}
+
+			_, err := os.Stat(filepath.Join(config.DeltaCachePath, repopath, baseoid+"-"+targetoid))
+			Expect(err).To(BeNil(), "Delta should have been cached")
+
+			// No usable base means the full content is sent
+			sendRawRequest(cli, "DownloadDelta", &DownloadDeltaRequest{targetoid, nil})
+			result := DownloadDeltaResponse{}
+			resp := readRawResponse(rdr, &result)
+			Expect(resp.Error).To(BeNil(), "Should be no error on DownloadDelta")
+			Expect(result.BaseOid).To(BeEmpty(), "Should not use a base")
+			Expect(result.DeltaSize).To(BeEquivalentTo(len(target)), "Should send the full object")
+			full := make([]byte, result.DeltaSize)
+			_, err = io.ReadFull(rdr, full)
+			Expect(err).To(BeNil(), "Should be able to read content")
+			Expect(full).To(Equal(target), "Should receive the full content")
+
+			// Only the first few stored bases are tried
+			var bases []string
+			for i := 0; i < deltaMaxBases; i++ {
+				other := bytes.Repeat([]byte{byte(i)}, 100)
+				obj, wrerr := ctx.UploadCheck(oidFor(other), int64(len(other)))
+				Expect(wrerr).To(BeNil(), "Should be no error on UploadCheck")
+				wrerr = ctx.UploadObject(obj, bytes.NewReader(other))
+				Expect(wrerr).To(BeNil(), "Should be no error on upload")
+				bases = append(bases, oidFor(other))
+			}
+			sendRawRequest(cli, "DownloadDelta", &DownloadDeltaRequest{targetoid, append(bases, baseoid)})
+			resp = readRawResponse(rdr, &result)
+			Expect(resp.Error).To(BeNil(), "Should be no error on DownloadDelta")
+			Expect(result.BaseOid).To(BeEmpty(), "Bases after the limit should not be tried")
+			full = make([]byte, result.DeltaSize)
+			_, err = io.ReadFull(rdr, full)
+			Expect(err).To(BeNil(), "Should be able to read content")
+
+			ctx.Close()
+		})
+	})
+})
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io"
+	"sync"
+)
+
+// In framed mode, which a client asks for with Version, everything in both
+// directions is sent in frames so that several requests can be in flight at once:
+//
+//   [type: 1 byte][request id: uint32 BE][payload length: uint32 BE][payload]
+//
+// 'J' frames hold a JSON request or response (no NUL terminator), 'D' frames
+// hold raw content belonging to a request (upload data from the client, download
+// data from the server) and an 'E' frame with no payload ends a request: the
+// client sends one after the last of its data for a request, and the server sends
+// one once it has finished handling a request and will send nothing more for it.
+// Requests are handled concurrently, so frames for different requests interleave.
+
+const framingMultiplex = "multiplex"
+
+const (
+	frameJSON byte = 'J'
+	frameData byte = 'D'
+	frameEnd  byte = 'E'
+)
+
+const frameHeaderSize = 9
+
+// Largest payload we'll send in a single frame
+const maxFramePayload = 64 * 1024
+
+// Largest payload we'll accept from a client in a single frame
+const maxFrameReceive = 16 * 1024 * 1024
+
+// Most data we'll hold for a request which hasn't read it yet; a request which
+// is sent more than this fails, rather than holding up the other requests
+const maxFrameBuffer = 4 * 1024 * 1024
+
+// Most requests a client can have in progress at once
+const maxFramedRequests = 32
+
+func readFrame(r io.Reader) (ftype byte, id int, payload []byte, err error) {
+	var hdr [frameHeaderSize]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	ftype = hdr[0]
+	id = int(binary.BigEndian.Uint32(hdr[1:5]))
+	length := binary.BigEndian.Uint32(hdr[5:9])
+	if length > maxFrameReceive {
+		return 0, 0, nil, fmt.Errorf("Frame for request %d is too large (%d bytes)", id, length)
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return ftype, id, payload, err
+}
+
+// Serialises whole frames from concurrent requests onto the output
+type frameMux struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (m *frameMux) writeFrame(ftype byte, id int, payload []byte) error {
+	var hdr [frameHeaderSize]byte
+	hdr[0] = ftype
+	binary.BigEndian.PutUint32(hdr[1:5], uint32(id))
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(len(payload)))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.w.Write(hdr[:])
+	if err == nil && len(payload) > 0 {
+		_, err = m.w.Write(payload)
+	}
+	return err
+}
+
+// The output of a single request in framed mode; raw writes become data frames
+// and sendResponse sends JSON frames
+type frameWriter struct {
+	mux *frameMux
+	id  int
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		err := fw.mux.writeFrame(frameData, fw.id, p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// The input of a single request in framed mode. Data frames are queued rather
+// than handed over synchronously so that a request which isn't reading yet
+// can't hold up frames for the others, up to maxFrameBuffer bytes.
+type frameReader struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	chunks   [][]byte
+	buffered int
+	eof      bool
+	// Set if the client sent more than can be queued; Read returns it
+	err error
+}
+
+func newFrameReader() *frameReader {
+	r := &frameReader{}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// Queue data for the request. If that would take it over maxFrameBuffer the
+// request fails instead, and everything else sent for it is dropped.
+func (r *frameReader) push(data []byte) {
+	r.mu.Lock()
+	if !r.eof && r.err == nil {
+		if r.buffered+len(data) > maxFrameBuffer && r.buffered > 0 {
+			r.err = fmt.Errorf("More than %d bytes of data were sent before the request read it", maxFrameBuffer)
+			r.chunks = nil
+			r.buffered = 0
+		} else {
+			r.chunks = append(r.chunks, data)
+			r.buffered += len(data)
+		}
+	}
+	r.mu.Unlock()
+	r.cond.Signal()
+}
+
+func (r *frameReader) close() {
+	r.mu.Lock()
+	r.eof = true
+	r.mu.Unlock()
+	r.cond.Signal()
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.chunks) == 0 && !r.eof && r.err == nil {
+		r.cond.Wait()
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n == len(r.chunks[0]) {
+		r.chunks = r.chunks[1:]
+	} else {
+		r.chunks[0] = r.chunks[0][n:]
+	}
+	r.buffered -= n
+	return n, nil
+}
+
+// Serve the rest of a session in framed mode, once Version has switched to it
+func serveFramed(rdr *bufio.Reader, out io.Writer, outerr io.Writer, config *Config, path string, sess *Session) int {
+	mux := &frameMux{w: out}
+	inputs := make(map[int]*frameReader)
+	var inputsMu sync.Mutex
+	var inflight sync.WaitGroup
+	// Make sure nothing is left waiting for input when we stop reading
+	defer func() {
+		inputsMu.Lock()
+		for _, r := range inputs {
+			r.close()
+		}
+		inputsMu.Unlock()
+		inflight.Wait()
+	}()
+
+	for {
+		ftype, id, payload, err := readFrame(rdr)
+		if err != nil {
+			if err == io.EOF {
+				// normal exit
+				return 0
+			}
+			fmt.Fprintf(outerr, "Unable to read frame from client: %v\n", err.Error())
+			logf("Unable to read frame from client: %v\n", err.Error())
+			return 24
+		}
+		switch ftype {
+		case frameJSON:
+			var req lfs.JsonRequest
+			debugf("Request %d JSON: %v\n", id, string(payload))
+			err = json.Unmarshal(payload, &req)
+			if err != nil {
+				fmt.Fprintf(outerr, "Unable to unmarhsal JSON: %v: %v\n", string(payload), err.Error())
+				logf("Unable to unmarhsal JSON: %v: %v\n", string(payload), err.Error())
+				return 22
+			}
+			if req.Method == "Exit" {
+				logf("Client exited\n")
+				return 0
+			}
+			fw := &frameWriter{mux: mux, id: id}
+			inputsMu.Lock()
+			if _, busy := inputs[id]; busy {
+				// Its frames can't be told apart from the request already using the id
+				inputsMu.Unlock()
+				fmt.Fprintf(outerr, "Request %d is already in progress\n", id)
+				logf("Request %d is already in progress\n", id)
+				return 24
+			}
+			if len(inputs) >= maxFramedRequests {
+				inputsMu.Unlock()
+				logf("Request %d refused, too many requests in progress\n", id)
+				sendResponse(lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Too many requests in progress, at most %d are allowed", maxFramedRequests)), fw)
+				mux.writeFrame(frameEnd, id, nil)
+				continue
+			}
+			input := newFrameReader()
+			inputs[id] = input
+			inputsMu.Unlock()
+
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				handleRequest(&req, input, fw, outerr, config, path, sess)
+				inputsMu.Lock()
+				delete(inputs, id)
+				inputsMu.Unlock()
+				mux.writeFrame(frameEnd, id, nil)
+			}()
+		case frameData, frameEnd:
+			inputsMu.Lock()
+			input := inputs[id]
+			inputsMu.Unlock()
+			if input == nil {
+				// Request has already finished, nothing to do with this
+				continue
+			}
+			if ftype == frameData {
+				input.push(payload)
+			} else {
+				input.close()
+			}
+		default:
+			fmt.Fprintf(outerr, "Unknown frame type %q from client\n", ftype)
+			logf("Unknown frame type %q from client\n", ftype)
+			return 24
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Framed mode", func() {
+
+	var config *Config
+	var repopath string
+	var cli net.Conn
+	var rdr *bufio.Reader
+	var mux *frameMux
+	var done chan int
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+
+		var srv net.Conn
+		cli, srv = net.Pipe()
+		done = make(chan int, 1)
+		go func() {
+			done <- Serve(srv, srv, GinkgoWriter, config, repopath, nil)
+			srv.Close()
+		}()
+		rdr = bufio.NewReader(cli)
+		mux = &frameMux{w: cli}
+
+		sendRawRequest(cli, "Version", &VersionRequest{Framing: framingMultiplex})
+		ver := VersionResponse{}
+		resp := readRawResponse(rdr, &ver)
+		Expect(resp.Error).To(BeNil(), "Should be no error on Version")
+		Expect(ver.Framing).To(Equal(framingMultiplex), "Server should agree to framed mode")
+	})
+	AfterEach(func() {
+		cli.Close()
+		<-done
+		os.RemoveAll(config.BasePath)
+	})
+
+	sendFramedRequest := func(id int, method string, params interface{}) {
+		req, err := lfs.NewJsonRequest(method, params)
+		Expect(err).To(BeNil())
+		req.Id = id
+		reqbytes, err := json.Marshal(req)
+		Expect(err).To(BeNil())
+		Expect(mux.writeFrame(frameJSON, id, reqbytes)).To(Succeed())
+	}
+
+	// What the server sent for each request, in the order it arrived
+	type framedResult struct {
+		responses []*lfs.JsonResponse
+		data      []byte
+	}
+	// Read frames until all of ids have ended
+	readUntilEnd := func(ids ...int) map[int]*framedResult {
+		results := make(map[int]*framedResult)
+		for _, id := range ids {
+			results[id] = &framedResult{}
+		}
+		remaining := len(ids)
+		for remaining > 0 {
+			ftype, id, payload, err := readFrame(rdr)
+			Expect(err).To(BeNil(), "Should be able to read frames")
+			r, ok := results[id]
+			Expect(ok).To(BeTrue(), "Should only get frames for requests in progress")
+			switch ftype {
+			case frameJSON:
+				resp := &lfs.JsonResponse{}
+				Expect(json.Unmarshal(payload, resp)).To(Succeed())
+				Expect(resp.Id).To(Equal(id), "Response id should match frame")
+				r.responses = append(r.responses, resp)
+			case frameData:
+				r.data = append(r.data, payload...)
+			case frameEnd:
+				remaining--
+			}
+		}
+		return results
+	}
+
+	It("Handles uploads and overlapping downloads", func() {
+		content := make([]byte, 3*maxFramePayload+100)
+		for i := range content {
+			content[i] = byte(i * 3)
+		}
+		oid := oidFor(content)
+
+		sendFramedRequest(1, "Upload", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+		for i := 0; i < len(content); i += 1000 {
+			end := i + 1000
+			if end > len(content) {
+				end = len(content)
+			}
+			mux.writeFrame(frameData, 1, content[i:end])
+		}
+		mux.writeFrame(frameEnd, 1, nil)
+		results := readUntilEnd(1)
+		Expect(results[1].responses).To(HaveLen(2), "Should get start and completion responses")
+		complete := lfs.UploadCompleteResponse{}
+		lfs.ExtractStructFromJsonRawMessage(results[1].responses[1].Result, &complete)
+		Expect(complete.ReceivedOk).To(BeTrue(), "Upload should be received OK")
+
+		// Several requests at once, including one which fails
+		garbageoid := "9999999999999999999999999999999999999999999999999999999999999999"
+		sendFramedRequest(2, "Download", &lfs.DownloadRequest{Oid: oid, Size: int64(len(content))})
+		sendFramedRequest(3, "DownloadCheck", &lfs.DownloadCheckRequest{Oid: oid})
+		sendFramedRequest(4, "Download", &lfs.DownloadRequest{Oid: garbageoid, Size: 10})
+		results = readUntilEnd(2, 3, 4)
+		Expect(results[2].responses).To(BeEmpty(), "Successful download has no JSON response")
+		Expect(results[2].data).To(Equal(content), "Downloaded content should be correct")
+		Expect(results[3].responses).To(HaveLen(1))
+		check := lfs.DownloadCheckResponse{}
+		lfs.ExtractStructFromJsonRawMessage(results[3].responses[0].Result, &check)
+		Expect(check.Size).To(BeEquivalentTo(len(content)), "DownloadCheck should report size")
+		Expect(results[4].responses).To(HaveLen(1))
+		Expect(results[4].responses[0].Error).ToNot(BeNil(), "Failed download should get an error response")
+
+		// Session still going after the failure
+		sendFramedRequest(5, "DownloadCheck", &lfs.DownloadCheckRequest{Oid: oid})
+		results = readUntilEnd(5)
+		Expect(results[5].responses).To(HaveLen(1))
+		Expect(results[5].responses[0].Error).To(BeNil(), "Should be no error after a failed download")
+
+		sendFramedRequest(6, "Exit", nil)
+		Eventually(done).Should(Receive(Equal(0)), "Session should exit cleanly")
+		done <- 0
+	})
+
+	It("Limits the requests in progress", func() {
+		// Uploads wait for their content, so stay in progress
+		for id := 1; id <= maxFramedRequests+1; id++ {
+			content := []byte(fmt.Sprintf("content %d", id))
+			sendFramedRequest(id, "Upload", &lfs.UploadRequest{Oid: oidFor(content), Size: int64(len(content))})
+		}
+		var refused *lfs.JsonResponse
+		for {
+			ftype, id, payload, err := readFrame(rdr)
+			Expect(err).To(BeNil(), "Should be able to read frames")
+			if id != maxFramedRequests+1 {
+				continue
+			}
+			if ftype == frameEnd {
+				break
+			}
+			refused = &lfs.JsonResponse{}
+			Expect(json.Unmarshal(payload, refused)).To(Succeed())
+		}
+		Expect(refused).ToNot(BeNil(), "Request over the limit should get a response")
+		Expect(refused.Error).To(ContainSubstring("Too many requests"))
+	})
+
+	It("Fails requests which are sent more data than can be queued", func() {
+		input := newFrameReader()
+		input.push(make([]byte, maxFrameBuffer))
+		input.push(make([]byte, 10))
+		input.push(make([]byte, 10))
+		_, err := input.Read(make([]byte, 1000))
+		Expect(err).ToNot(BeNil(), "Request should fail rather than hold up the client")
+		Expect(err.Error()).To(ContainSubstring("before the request read it"))
+	})
+
+	It("Ends the session if a request id is reused while in progress", func() {
+		content := []byte("content which never arrives")
+		sendFramedRequest(1, "Upload", &lfs.UploadRequest{Oid: oidFor(content), Size: int64(len(content))})
+		go io.Copy(ioutil.Discard, rdr)
+		sendFramedRequest(1, "DownloadCheck", &lfs.DownloadCheckRequest{Oid: oidFor(content)})
+		Eventually(done).Should(Receive(Equal(24)), "Session should end with an error")
+		done <- 24
+	})
+})
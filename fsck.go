@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// git-lfs-ssh-serve fsck [repo-path] [--quarantine] [--json]
+//
+// Re-hashes every object in the store (or just under repo-path) and reports any
+// whose content doesn't match its oid, plus stray temp files left in the object
+// layout. With --quarantine, bad objects are moved out of the store so they're no
+// longer offered to clients. Exits with 40 if any problems were found.
+
+const quarantineDirName = ".quarantine"
+
+// Directory names in the xx/yy object layout
+var shardRegex = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+// SHA-256 of no content, the only valid zero length object
+const emptyOid = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type FsckProblem struct {
+	Path string `json:"path"`
+	Oid  string `json:"oid,omitempty"`
+	// Local filename, for problems which aren't objects in the store
+	File        string `json:"file,omitempty"`
+	Problem     string `json:"problem"`
+	Detail      string `json:"detail"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+}
+
+type FsckReport struct {
+	Checked  int           `json:"checked"`
+	Bytes    int64         `json:"bytes"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+func runFsck(cfg *Config, user *User, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	quarantine := flags.Bool("quarantine", false, "Move bad objects out of the store into the quarantine directory")
+	asjson := flags.Bool("json", false, "Output a JSON report")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 18
+	}
+	if len(positional) > 1 {
+		outputf("Usage: git-lfs-ssh-serve fsck [repo-path] [--quarantine] [--json]\n")
+		return 18
+	}
+	repo := ""
+	if len(positional) == 1 {
+		repo, err = resolveRepoPath(cfg.BasePath, positional[0])
+		if err != nil {
+			outputf("Path argument %v invalid: %v\n", positional[0], err.Error())
+			return 19
+		}
+	}
+	if code := requireAdmin(cfg, user, repo); code != 0 {
+		return code
+	}
+	store, err := NewStore(cfg)
+	if err != nil {
+		outputf("Unable to open store: %v\n", err.Error())
+		return 25
+	}
+
+	report, err := fsckStore(store, cfg, repo, *quarantine)
+	if err != nil {
+		outputf("Unable to check store: %v\n", err.Error())
+		return 41
+	}
+	if *asjson {
+		if report.Problems == nil {
+			report.Problems = []FsckProblem{}
+		}
+		enc, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Fprintf(out, "%s\n", enc)
+	} else {
+		for _, p := range report.Problems {
+			what := p.Oid
+			if what == "" {
+				what = p.File
+			}
+			suffix := ""
+			if p.Quarantined {
+				suffix = " (quarantined)"
+			}
+			fmt.Fprintf(out, "%v %v %v: %v%v\n", p.Problem, p.Path, what, p.Detail, suffix)
+		}
+		fmt.Fprintf(out, "Checked %d objects (%d bytes), %d problems found\n", report.Checked, report.Bytes, len(report.Problems))
+	}
+	if len(report.Problems) > 0 {
+		return 40
+	}
+	return 0
+}
+
+func fsckStore(store Store, cfg *Config, repo string, quarantine bool) (*FsckReport, error) {
+	report := &FsckReport{}
+	var bad []FsckProblem
+	err := store.List(repo, func(obj ObjectInfo) error {
+		report.Checked++
+		report.Bytes += obj.Size
+		if problem, detail := checkObject(store, obj); problem != "" {
+			bad = append(bad, FsckProblem{Path: obj.Path, Oid: obj.Oid, Problem: problem, Detail: detail})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Move things after listing so the listing isn't disturbed
+	for i := range bad {
+		if quarantine {
+			if err := quarantineObject(store, cfg, bad[i].Path, bad[i].Oid); err != nil {
+				logf("fsck: unable to quarantine %v: %v\n", bad[i].Oid, err.Error())
+			} else {
+				bad[i].Quarantined = true
+				removeCachedDeltas(cfg, bad[i].Path, bad[i].Oid)
+			}
+		}
+		logf("fsck: %v %v %v: %v\n", bad[i].Problem, bad[i].Path, bad[i].Oid, bad[i].Detail)
+	}
+	report.Problems = bad
+
+	if _, ok := store.(*fsStore); ok {
+		strays, err := findStrays(cfg, repo)
+		if err != nil {
+			return nil, err
+		}
+		report.Problems = append(report.Problems, strays...)
+	}
+	return report, nil
+}
+
+// Re-hash an object, returning the kind of problem & details if it's bad
+func checkObject(store Store, obj ObjectInfo) (problem, detail string) {
+	if obj.Size == 0 && obj.Oid != emptyOid {
+		return "empty", "object has no content"
+	}
+	f, err := store.Open(obj.Path, obj.Oid)
+	if err != nil {
+		return "unreadable", err.Error()
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, f)
+	if err != nil {
+		return "unreadable", fmt.Sprintf("error after %d bytes: %v", n, err.Error())
+	}
+	if n != obj.Size {
+		return "truncated", fmt.Sprintf("read %d bytes, expected %d", n, obj.Size)
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != obj.Oid {
+		return "corrupt", fmt.Sprintf("content hashes to %v", sum)
+	}
+	return "", ""
+}
+
+func quarantineDir(cfg *Config) string {
+	if cfg.QuarantinePath != "" {
+		return cfg.QuarantinePath
+	}
+	return filepath.Join(cfg.BasePath, quarantineDirName)
+}
+
+// Move a bad object out of the store into the quarantine directory
+func quarantineObject(store Store, cfg *Config, path, oid string) error {
+	dest := filepath.Join(quarantineDir(cfg), path, oid)
+	if err := ensureDirExists(filepath.Dir(dest), cfg); err != nil {
+		return err
+	}
+	if _, ok := store.(*fsStore); ok {
+		filename, err := mediaPath(oid, cfg, path)
+		if err != nil {
+			return err
+		}
+		return moveIntoPlace(filename, dest)
+	}
+	// Keep whatever can be read for inspection, but remove it from the store anyway
+	if f, err := store.Open(path, oid); err == nil {
+		if qf, err := os.Create(dest); err == nil {
+			io.Copy(qf, f)
+			qf.Close()
+		}
+		f.Close()
+	}
+	return store.Delete(path, oid)
+}
+
+// Find leftover temp files and misplaced files in the filesystem object layout
+func findStrays(cfg *Config, repo string) ([]FsckProblem, error) {
+	var strays []FsckProblem
+	root := filepath.Join(cfg.BasePath, repo)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if p == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if strings.HasPrefix(fi.Name(), ".") && p != root {
+				// staging, delta cache, quarantine etc
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := fi.Name()
+		dir := filepath.Dir(p)
+		shard1, shard2 := filepath.Base(filepath.Dir(dir)), filepath.Base(dir)
+		inLayout := shardRegex.MatchString(shard1) && shardRegex.MatchString(shard2)
+		isObject := validOid(name) && name[0:2] == shard1 && name[2:4] == shard2
+		if isObject || (!inLayout && !strings.HasPrefix(name, "temp")) {
+			return nil
+		}
+		repopath := ""
+		if inLayout {
+			repopath, _ = filepath.Rel(cfg.BasePath, filepath.Dir(filepath.Dir(dir)))
+		} else {
+			repopath, _ = filepath.Rel(cfg.BasePath, dir)
+		}
+		problem := FsckProblem{Path: repopath, File: p, Problem: "stray", Detail: "not an object"}
+		if strings.HasPrefix(name, "temp") {
+			problem.Detail = "leftover temp file"
+		}
+		strays = append(strays, problem)
+		return nil
+	})
+	if err == filepath.SkipDir {
+		err = nil
+	}
+	return strays, err
+}
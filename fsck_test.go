@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Store integrity check", func() {
+
+	var config *Config
+	var store Store
+	var repopath string
+	var goodoid, corruptoid, emptiedoid string
+
+	storeObject := func(content string) string {
+		oid := oidFor([]byte(content))
+		w, _ := store.Begin(repopath, oid)
+		w.Write([]byte(content))
+		Expect(w.Commit()).To(Succeed())
+		return oid
+	}
+	overwrite := func(oid, content string) {
+		filename, _ := mediaPath(oid, config, repopath)
+		Expect(ioutil.WriteFile(filename, []byte(content), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+		store, _ = NewStore(config)
+
+		goodoid = storeObject("intact")
+		corruptoid = storeObject("will be damaged")
+		emptiedoid = storeObject("will be emptied")
+		overwrite(corruptoid, "has been damaged")
+		overwrite(emptiedoid, "")
+		filename, _ := mediaPath(goodoid, config, repopath)
+		ioutil.WriteFile(filepath.Join(filepath.Dir(filename), "tempcopy123"), []byte("leftover"), 0644)
+	})
+	AfterEach(func() {
+		os.RemoveAll(config.BasePath)
+	})
+
+	fsck := func(args ...string) (int, string) {
+		var out bytes.Buffer
+		code := runFsck(config, nil, args, &out)
+		return code, out.String()
+	}
+
+	It("Passes a clean store", func() {
+		code, out := fsck("other/repo")
+		Expect(code).To(BeZero())
+		Expect(out).To(Equal("Checked 0 objects (0 bytes), 0 problems found\n"))
+	})
+
+	It("Reports bad objects and stray files", func() {
+		code, out := fsck(repopath)
+		Expect(code).To(Equal(40))
+		Expect(out).To(ContainSubstring("corrupt test/repo " + corruptoid))
+		Expect(out).To(ContainSubstring("empty test/repo " + emptiedoid))
+		Expect(out).To(ContainSubstring("stray test/repo "))
+		Expect(out).To(ContainSubstring("Checked 3 objects"))
+		Expect(out).To(ContainSubstring("3 problems found"))
+		Expect(out).ToNot(ContainSubstring(goodoid))
+		Expect(objectExists(store, repopath, corruptoid)).To(BeTrue(), "Nothing should be moved without --quarantine")
+	})
+
+	It("Writes a JSON report", func() {
+		code, out := fsck("--json")
+		Expect(code).To(Equal(40))
+		var report FsckReport
+		Expect(json.Unmarshal([]byte(out), &report)).To(Succeed())
+		Expect(report.Checked).To(Equal(3))
+		problems := make(map[string]string)
+		for _, p := range report.Problems {
+			problems[p.Oid+p.File] = p.Problem
+		}
+		Expect(problems).To(HaveKeyWithValue(corruptoid, "corrupt"))
+		Expect(problems).To(HaveKeyWithValue(emptiedoid, "empty"))
+		Expect(problems).To(ContainElement("stray"))
+	})
+
+	It("Quarantines bad objects so they aren't offered to clients", func() {
+		config.DeltaCachePath = filepath.Join(config.BasePath, ".deltacache")
+		cachedir := filepath.Join(config.DeltaCachePath, repopath)
+		os.MkdirAll(cachedir, 0755)
+		for _, name := range []string{goodoid + "-" + corruptoid, corruptoid + "-" + goodoid, goodoid + "-" + emptiedoid} {
+			ioutil.WriteFile(filepath.Join(cachedir, name), []byte("delta"), 0644)
+		}
+		code, out := fsck(repopath, "--quarantine")
+		Expect(code).To(Equal(40))
+		Expect(out).To(ContainSubstring(corruptoid + ": content hashes to"))
+		Expect(out).To(ContainSubstring("(quarantined)"))
+		Expect(objectExists(store, repopath, corruptoid)).To(BeFalse(), "Corrupt object should be removed from the store")
+		Expect(objectExists(store, repopath, emptiedoid)).To(BeFalse(), "Empty object should be removed from the store")
+		content, err := ioutil.ReadFile(filepath.Join(config.BasePath, ".quarantine", repopath, corruptoid))
+		Expect(err).To(BeNil(), "Corrupt object should be in quarantine")
+		Expect(string(content)).To(Equal("has been damaged"))
+		cached, _ := ioutil.ReadDir(cachedir)
+		Expect(cached).To(BeEmpty(), "Cached deltas to or from quarantined objects should be removed")
+
+		cli, srv := net.Pipe()
+		go Serve(srv, srv, GinkgoWriter, config, repopath, nil)
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+		_, wrerr := ctx.DownloadCheck(corruptoid)
+		Expect(wrerr).ToNot(BeNil(), "Quarantined object should not be downloadable")
+		_, wrerr = ctx.DownloadCheck(goodoid)
+		Expect(wrerr).To(BeNil(), "Good object should still be downloadable")
+		ctx.Close()
+
+		code, out = fsck(repopath)
+		Expect(out).To(ContainSubstring("Checked 1 objects"))
+		Expect(out).To(ContainSubstring("1 problems found"), "Only the stray file should remain")
+	})
+})
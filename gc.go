@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// git-lfs-ssh-serve gc <repo-path> --git-dir <bare repo> [--since <duration>] [--grace <duration>] [--dry-run]
+//
+// Removes objects from a repo path's store which aren't referenced by any LFS
+// pointer in the git repo. Everything reachable from the tip of any ref is always
+// kept; with --since only history that recent is scanned beyond that, so objects
+// only used by older commits are removed. Objects stored more recently than the
+// grace period are always kept, since they may belong to a push in progress.
+
+// Pointer files are always smaller than this, anything larger isn't worth reading
+const maxPointerSize = 1024
+
+func runGC(cfg *Config, user *User, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	gitdir := flags.String("git-dir", "", "Path to the git repository whose objects are kept in repo-path")
+	since := flags.Duration("since", cfg.GCRetention, "Only scan history this recent (0 for all), as well as ref tips")
+	grace := flags.Duration("grace", cfg.GCGracePeriod, "Keep objects stored more recently than this regardless")
+	dryrun := flags.Bool("dry-run", false, "Report what would be removed without removing anything")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 18
+	}
+	if len(positional) != 1 || *gitdir == "" {
+		outputf("Usage: git-lfs-ssh-serve gc <repo-path> --git-dir <git repo> [--since <duration>] [--grace <duration>] [--dry-run]\n")
+		return 18
+	}
+	repo, err := resolveRepoPath(cfg.BasePath, positional[0])
+	if err != nil {
+		outputf("Path argument %v invalid: %v\n", positional[0], err.Error())
+		return 19
+	}
+	if code := requireAdmin(cfg, user, repo); code != 0 {
+		return code
+	}
+	store, err := NewStore(cfg)
+	if err != nil {
+		outputf("Unable to open store: %v\n", err.Error())
+		return 25
+	}
+
+	referenced, err := referencedOids(*gitdir, *since)
+	if err != nil {
+		outputf("Unable to find LFS objects used by %v: %v\n", *gitdir, err.Error())
+		return 41
+	}
+	logf("gc: %d objects referenced by %v\n", len(referenced), *gitdir)
+
+	var garbage []ObjectInfo
+	var kept, recent int
+	err = store.List(repo, func(obj ObjectInfo) error {
+		if toSlash(obj.Path) != toSlash(repo) {
+			// Some other repo nested under this path
+			return nil
+		}
+		if referenced[obj.Oid] {
+			kept++
+		} else if time.Since(obj.ModTime) < *grace {
+			recent++
+		} else {
+			garbage = append(garbage, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		outputf("Unable to list objects in %v: %v\n", repo, err.Error())
+		return 41
+	}
+
+	var freed int64
+	removed := 0
+	for _, obj := range garbage {
+		if *dryrun {
+			fmt.Fprintf(out, "would remove %v (%d bytes)\n", obj.Oid, obj.Size)
+		} else {
+			if err := store.Delete(repo, obj.Oid); err != nil {
+				outputf("Unable to remove %v: %v\n", obj.Oid, err.Error())
+				continue
+			}
+			removeCachedDeltas(cfg, repo, obj.Oid)
+			logf("gc: removed %v (%d bytes)\n", obj.Oid, obj.Size)
+			fmt.Fprintf(out, "removed %v (%d bytes)\n", obj.Oid, obj.Size)
+		}
+		removed++
+		freed += obj.Size
+	}
+	verb := "removed"
+	if *dryrun {
+		verb = "would be removed"
+	}
+	fmt.Fprintf(out, "%d unreferenced objects %v, %d bytes freed; %d referenced and %d within grace period kept\n", removed, verb, freed, kept, recent)
+	return 0
+}
+
+// Find the oids of all LFS pointers at the tips of refs in gitdir, plus those in
+// any commits more recent than since if it's non-zero, or all history if it's zero
+func referencedOids(gitdir string, since time.Duration) (map[string]bool, error) {
+	var revlists [][]string
+	if since == 0 {
+		revlists = append(revlists, []string{"rev-list", "--objects", "--all"})
+	} else {
+		revlists = append(revlists,
+			[]string{"rev-list", "--objects", "--all", "--no-walk"},
+			[]string{"rev-list", "--objects", "--all", fmt.Sprintf("--since=%d", time.Now().Add(-since).Unix())})
+	}
+	shas := make(map[string]bool)
+	var ordered []string
+	for _, args := range revlists {
+		output, err := gitOutput(gitdir, nil, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && !shas[fields[0]] {
+				shas[fields[0]] = true
+				ordered = append(ordered, fields[0])
+			}
+		}
+	}
+
+	// Only small blobs can be pointers
+	output, err := gitOutput(gitdir, strings.NewReader(strings.Join(ordered, "\n")+"\n"), "cat-file", "--batch-check=%(objectname) %(objecttype) %(objectsize)")
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == "blob" {
+			if size, err := strconv.Atoi(fields[2]); err == nil && size < maxPointerSize {
+				candidates = append(candidates, fields[0])
+			}
+		}
+	}
+
+	oids := make(map[string]bool)
+	if len(candidates) == 0 {
+		return oids, nil
+	}
+	output, err = gitOutput(gitdir, strings.NewReader(strings.Join(candidates, "\n")+"\n"), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	// Each is "<sha> <type> <size>\n<content>\n"
+	rdr := bufio.NewReader(bytes.NewReader(output))
+	for {
+		header, err := rdr.ReadString('\n')
+		if err != nil {
+			break
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected output from git cat-file: %v", header)
+		}
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(rdr, content); err != nil {
+			return nil, fmt.Errorf("Unexpected output from git cat-file: %v", err.Error())
+		}
+		if p, err := lfs.DecodePointer(bytes.NewReader(content[:size])); err == nil && validOid(p.Oid) {
+			oids[p.Oid] = true
+		}
+	}
+	return oids, nil
+}
+
+func gitOutput(gitdir string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", gitdir}, args...)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %v failed: %v %v", args[0], err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Remove any deltas to or from oid from the delta cache
+func removeCachedDeltas(cfg *Config, path, oid string) {
+	if cfg.DeltaCachePath == "" {
+		return
+	}
+	dir := filepath.Join(cfg.DeltaCachePath, path)
+	for _, pattern := range []string{oid + "-*", "*-" + oid} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, m := range matches {
+			os.Remove(m)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Garbage collection", func() {
+
+	var config *Config
+	var store Store
+	var repopath string
+	var workdir string
+	// oids of objects used in an old commit, the current commit, and neither
+	var oldoid, currentoid, unusedoid, recentoid string
+
+	git := func(date time.Time, args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = workdir
+		stamp := fmt.Sprintf("%d +0000", date.Unix())
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+stamp, "GIT_COMMITTER_DATE="+stamp)
+		output, err := cmd.CombinedOutput()
+		Expect(err).To(BeNil(), "git %v failed: %v", args, string(output))
+	}
+	storeObject := func(content string, modtime time.Time) string {
+		oid := oidFor([]byte(content))
+		w, _ := store.Begin(repopath, oid)
+		w.Write([]byte(content))
+		Expect(w.Commit()).To(Succeed())
+		filename, _ := mediaPath(oid, config, repopath)
+		os.Chtimes(filename, modtime, modtime)
+		return oid
+	}
+	writePointer := func(oid string) {
+		pointer := fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%v\nsize 10\n", oid)
+		Expect(ioutil.WriteFile(filepath.Join(workdir, "file.bin"), []byte(pointer), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		config.DeltaCachePath = filepath.Join(config.BasePath, ".deltacache")
+		repopath = "test/repo"
+		store, _ = NewStore(config)
+		workdir = filepath.Join(os.TempDir(), "git-lfs-serve-test-git")
+		os.RemoveAll(workdir)
+		os.MkdirAll(workdir, 0755)
+
+		longago := time.Now().Add(-3 * 365 * 24 * time.Hour)
+		oldoid = storeObject("old version", longago)
+		currentoid = storeObject("current version", longago)
+		unusedoid = storeObject("never committed", longago)
+		recentoid = storeObject("just pushed", time.Now())
+
+		git(longago, "init", "-q")
+		writePointer(oldoid)
+		ioutil.WriteFile(filepath.Join(workdir, "big.txt"), bytes.Repeat([]byte("not a pointer\n"), 100), 0644)
+		git(longago, "add", ".")
+		git(longago, "commit", "-q", "-m", "old")
+		writePointer(currentoid)
+		git(time.Now(), "commit", "-q", "-a", "-m", "current")
+	})
+	AfterEach(func() {
+		os.RemoveAll(config.BasePath)
+		os.RemoveAll(workdir)
+	})
+
+	gc := func(args ...string) (int, string) {
+		var out bytes.Buffer
+		code := runGC(config, nil, append([]string{repopath, "--git-dir", filepath.Join(workdir, ".git")}, args...), &out)
+		return code, out.String()
+	}
+
+	It("Finds pointers in history", func() {
+		oids, err := referencedOids(filepath.Join(workdir, ".git"), 0)
+		Expect(err).To(BeNil())
+		Expect(oids).To(Equal(map[string]bool{oldoid: true, currentoid: true}))
+	})
+
+	It("Only reports what it would remove in a dry run", func() {
+		code, out := gc("--dry-run")
+		Expect(code).To(BeZero())
+		Expect(out).To(ContainSubstring("would remove " + unusedoid))
+		Expect(out).To(ContainSubstring("1 unreferenced objects would be removed"))
+		Expect(objectExists(store, repopath, unusedoid)).To(BeTrue(), "Nothing should be removed in a dry run")
+	})
+
+	It("Removes unreferenced objects outside the grace period", func() {
+		deltafile := filepath.Join(config.DeltaCachePath, repopath, currentoid+"-"+unusedoid)
+		os.MkdirAll(filepath.Dir(deltafile), 0755)
+		ioutil.WriteFile(deltafile, []byte("delta"), 0644)
+
+		code, out := gc()
+		Expect(code).To(BeZero())
+		Expect(out).To(ContainSubstring(fmt.Sprintf("1 unreferenced objects removed, %d bytes freed; 2 referenced and 1 within grace period kept", len("never committed"))))
+		Expect(objectExists(store, repopath, unusedoid)).To(BeFalse(), "Unreferenced object should be removed")
+		Expect(objectExists(store, repopath, oldoid)).To(BeTrue(), "Object in history should be kept")
+		Expect(objectExists(store, repopath, currentoid)).To(BeTrue(), "Object at ref tip should be kept")
+		Expect(objectExists(store, repopath, recentoid)).To(BeTrue(), "Recent object should be kept")
+		_, err := os.Stat(deltafile)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Cached deltas for removed object should be removed")
+	})
+
+	It("Only keeps objects from recent history with a retention window", func() {
+		code, _ := gc("--since", "8760h")
+		Expect(code).To(BeZero())
+		Expect(objectExists(store, repopath, oldoid)).To(BeFalse(), "Object only in old history should be removed")
+		Expect(objectExists(store, repopath, currentoid)).To(BeTrue(), "Object at ref tip should be kept")
+	})
+
+	It("Needs admin access when access rules are configured", func() {
+		config.AccessRules = []*AccessRule{{Users: []string{"*"}, Paths: []string{"**"}, Permission: PermissionWrite}}
+		code, _ := gc()
+		Expect(code).To(Equal(20))
+		Expect(objectExists(store, repopath, unusedoid)).To(BeTrue())
+	})
+})
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"strings"
+	"time"
+)
+
+// git-lfs-ssh-serve serve-http [--listen <address>]
+//
+// Serves the standard LFS HTTP Batch API from the same store, for clients which
+// authenticate over SSH with git-lfs-authenticate and then transfer over HTTP.
+// Every request must carry a token issued by git-lfs-authenticate for its repo
+// path. URLs are relative to the href that gave out:
+//
+//   POST <path>/objects/batch         Batch API
+//   GET  <path>/objects/<oid>         download
+//   PUT  <path>/objects/<oid>         upload
+//   POST <path>/objects/<oid>/verify  check an upload arrived
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+// Largest JSON body accepted, and most objects accepted in one batch
+const httpMaxJSONBody = 1024 * 1024
+const httpMaxBatchObjects = 1000
+
+// Timeouts for clients which are slow to send request headers, or which keep an
+// idle connection open; bodies aren't timed since they can be whole objects
+const httpReadHeaderTimeout = 30 * time.Second
+const httpIdleTimeout = 2 * time.Minute
+
+type httpBatchRequest struct {
+	Operation string             `json:"operation"`
+	Transfers []string           `json:"transfers,omitempty"`
+	Objects   []*httpBatchObject `json:"objects"`
+	HashAlgo  string             `json:"hash_algo,omitempty"`
+}
+
+type httpBatchResponse struct {
+	Transfer string             `json:"transfer"`
+	Objects  []*httpBatchObject `json:"objects"`
+	HashAlgo string             `json:"hash_algo,omitempty"`
+}
+
+type httpBatchObject struct {
+	Oid           string                 `json:"oid"`
+	Size          int64                  `json:"size"`
+	Authenticated bool                   `json:"authenticated,omitempty"`
+	Actions       map[string]*httpAction `json:"actions,omitempty"`
+	Error         *httpObjectError       `json:"error,omitempty"`
+}
+
+type httpAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
+}
+
+type httpObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// A request which has been authorised for a repo path
+type httpRequest struct {
+	*http.Request
+	path  string
+	token *authToken
+	user  *User
+}
+
+type httpServer struct {
+	config *Config
+	store  Store
+}
+
+func runServeHTTP(cfg *Config, user *User, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("serve-http", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	listen := flags.String("listen", cfg.HTTPListen, "Address to listen on, e.g. :8080")
+	if err := flags.Parse(args); err != nil {
+		return 18
+	}
+	if flags.NArg() != 0 {
+		outputf("Usage: git-lfs-ssh-serve serve-http [--listen <address>]\n")
+		return 18
+	}
+	if cfg.AuthSecret == "" {
+		outputf("serve-http is not available, auth-secret must be configured\n")
+		return 26
+	}
+	store, err := NewStore(cfg)
+	if err != nil {
+		outputf("Unable to open store: %v\n", err.Error())
+		return 25
+	}
+	fmt.Fprintf(out, "Serving LFS HTTP API on %v\n", *listen)
+	logf("Serving LFS HTTP API on %v\n", *listen)
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           newHTTPHandler(cfg, store),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		outputf("Unable to serve HTTP: %v\n", err.Error())
+		return 27
+	}
+	return 0
+}
+
+func newHTTPHandler(config *Config, store Store) http.Handler {
+	return &httpServer{config: config, store: store}
+}
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logf("HTTP %v %v\n", r.Method, r.URL.Path)
+	urlpath, ok := s.stripURLPrefix(r.URL.Path)
+	if !ok {
+		httpError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	i := strings.LastIndex(urlpath, "/objects/")
+	if i < 0 {
+		httpError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	rest := urlpath[i+len("/objects/"):]
+	var handler func(w http.ResponseWriter, req *httpRequest)
+	var operation string
+	switch {
+	case rest == "batch" && r.Method == "POST":
+		// Operation is checked once the body has been read
+		handler = s.batch
+	case validOid(rest) && r.Method == "GET":
+		handler, operation = s.download, transferDownload
+	case validOid(rest) && r.Method == "PUT":
+		handler, operation = s.upload, transferUpload
+	case strings.HasSuffix(rest, "/verify") && validOid(strings.TrimSuffix(rest, "/verify")) && r.Method == "POST":
+		handler, operation = s.verify, transferUpload
+	default:
+		httpError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	req, code, err := s.authorise(r, urlpath[:i])
+	if err == nil && operation != "" {
+		code, err = req.check(s.config, operation)
+	}
+	if err != nil {
+		logf("HTTP request refused: %v\n", err.Error())
+		httpError(w, code, err.Error())
+		return
+	}
+	handler(w, req)
+}
+
+// Remove the path of http-url from the start of a request path, since hrefs
+// include it, e.g. when serving behind a proxy under https://host/lfs
+func (s *httpServer) stripURLPrefix(urlpath string) (string, bool) {
+	base, err := url.Parse(s.config.HTTPURL)
+	if err != nil {
+		return urlpath, true
+	}
+	prefix := strings.TrimSuffix(base.Path, "/")
+	if prefix == "" {
+		return urlpath, true
+	}
+	if !strings.HasPrefix(urlpath, prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(urlpath, prefix), true
+}
+
+// Check the request's token is good for the repo path in its URL
+func (s *httpServer) authorise(r *http.Request, urlpath string) (*httpRequest, int, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, http.StatusUnauthorized, fmt.Errorf("Authorization required, use %v over SSH", authenticateProgram)
+	}
+	token, err := verifyToken(s.config.AuthSecret, strings.TrimPrefix(auth, "Bearer "), time.Now())
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	path, err := resolveRepoPath(s.config.BasePath, strings.TrimPrefix(urlpath, "/"))
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if toSlash(path) != token.Path {
+		return nil, http.StatusForbidden, fmt.Errorf("Token is not valid for %v", toSlash(path))
+	}
+	return &httpRequest{Request: r, path: path, token: token, user: IdentifyUser(token.User, s.config)}, 0, nil
+}
+
+// Check the token allows operation and the user still has permission for it
+func (req *httpRequest) check(config *Config, operation string) (int, error) {
+	if !req.token.allows(operation) {
+		return http.StatusForbidden, fmt.Errorf("Token only allows %v", req.token.Operation)
+	}
+	required := PermissionRead
+	if operation == transferUpload {
+		required = PermissionWrite
+	}
+	if config.PermissionFor(req.user, req.path) < required {
+		return http.StatusForbidden, fmt.Errorf("Permission denied: %v does not have %v access to %v", req.user, required, req.path)
+	}
+	return 0, nil
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func (s *httpServer) batch(w http.ResponseWriter, req *httpRequest) {
+	batchreq := httpBatchRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, httpMaxJSONBody)).Decode(&batchreq); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("Invalid batch request: %v", err.Error()))
+		return
+	}
+	if len(batchreq.Objects) > httpMaxBatchObjects {
+		httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Too many objects in batch, at most %d are allowed", httpMaxBatchObjects))
+		return
+	}
+	if batchreq.Operation != transferUpload && batchreq.Operation != transferDownload {
+		httpError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Unknown operation '%v'", batchreq.Operation))
+		return
+	}
+	if code, err := req.check(s.config, batchreq.Operation); err != nil {
+		httpError(w, code, err.Error())
+		return
+	}
+	if batchreq.HashAlgo != "" && batchreq.HashAlgo != "sha256" {
+		httpError(w, http.StatusConflict, fmt.Sprintf("Unsupported hash algorithm %v", batchreq.HashAlgo))
+		return
+	}
+	basic := len(batchreq.Transfers) == 0
+	for _, t := range batchreq.Transfers {
+		basic = basic || t == "basic"
+	}
+	if !basic {
+		httpError(w, http.StatusUnprocessableEntity, "Only the basic transfer adapter is supported")
+		return
+	}
+	logf("HTTP batch: %d objects requested for %v\n", len(batchreq.Objects), batchreq.Operation)
+
+	base := s.baseURL(req) + "/objects/"
+	header := map[string]string{"Authorization": req.Header.Get("Authorization")}
+	expires := req.token.Expires.UTC().Format(time.RFC3339)
+	var uploadsize int64
+	var uploads []*httpBatchObject
+	for _, o := range batchreq.Objects {
+		if !validOid(o.Oid) || o.Size < 0 {
+			o.Error = &httpObjectError{Code: http.StatusUnprocessableEntity, Message: "Invalid object"}
+			continue
+		}
+		size, err := s.store.Size(req.path, o.Oid)
+		if err == nil && o.Size != 0 && o.Size != size {
+			o.Error = &httpObjectError{Code: http.StatusConflict, Message: sizeConflictMessage(o.Oid, size, o.Size)}
+			continue
+		}
+		if batchreq.Operation == transferUpload {
+			if err == nil {
+				// Already present, nothing to do
+				continue
+			}
+			uploadsize += o.Size
+			uploads = append(uploads, o)
+			o.Actions = map[string]*httpAction{
+				"upload": {Href: base + o.Oid, Header: header, ExpiresAt: expires},
+				"verify": {Href: base + o.Oid + "/verify", Header: header, ExpiresAt: expires},
+			}
+		} else if err != nil {
+			o.Error = &httpObjectError{Code: http.StatusNotFound, Message: fmt.Sprintf("Object %v does not exist", o.Oid)}
+		} else {
+			o.Size = size
+			o.Actions = map[string]*httpAction{
+				"download": {Href: base + o.Oid, Header: header, ExpiresAt: expires},
+			}
+		}
+		o.Authenticated = true
+	}
+	if uploadsize > 0 {
+		usages := quotaUsages(s.config, s.store, req.user, req.path)
+		if checkUsage(usages, uploadsize) != nil {
+			// Not everything fits, so offer uploads in order until the quota is reached
+			uploadsize = 0
+			for _, o := range uploads {
+				if err := checkUsage(usages, uploadsize+o.Size); err != nil {
+					o.Actions = nil
+					o.Authenticated = false
+					o.Error = &httpObjectError{Code: http.StatusRequestEntityTooLarge, Message: err.Error()}
+					continue
+				}
+				uploadsize += o.Size
+			}
+		}
+	}
+	w.Header().Set("Content-Type", lfsMediaType)
+	json.NewEncoder(w).Encode(&httpBatchResponse{Transfer: "basic", Objects: batchreq.Objects})
+}
+
+// URL of the repo path's API, which actions are relative to
+func (s *httpServer) baseURL(req *httpRequest) string {
+	if s.config.HTTPURL != "" {
+		return strings.TrimSuffix(s.config.HTTPURL, "/") + "/" + toSlash(req.path)
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + "/" + toSlash(req.path)
+}
+
+func (s *httpServer) download(w http.ResponseWriter, req *httpRequest) {
+	oid := pathpkg.Base(req.URL.Path)
+	f, err := s.store.Open(req.path, oid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, fmt.Sprintf("Object %v does not exist", oid))
+		} else {
+			httpError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	defer f.Close()
+	logf("HTTP download: sending %v\n", oid)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// Handles Range requests too
+	http.ServeContent(w, req.Request, oid, time.Time{}, f)
+}
+
+func (s *httpServer) upload(w http.ResponseWriter, req *httpRequest) {
+	oid := pathpkg.Base(req.URL.Path)
+	size := req.ContentLength
+	if size < 0 {
+		httpError(w, http.StatusLengthRequired, "Content-Length is required")
+		return
+	}
+	if stored, err := s.store.Size(req.path, oid); err == nil {
+		if stored != size {
+			httpError(w, http.StatusConflict, sizeConflictMessage(oid, stored, size))
+			return
+		}
+		logf("HTTP upload: content already exists for %v\n", oid)
+		return
+	}
+	if err := checkQuota(s.config, s.store, req.user, req.path, size); err != nil {
+		httpError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	}
+	lock, exists, err := lockUpload(oid, s.store, s.config, req.path, false)
+	if err != nil {
+		httpError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if exists {
+		logf("HTTP upload: content for %v was uploaded by another connection\n", oid)
+		return
+	}
+	defer lock.release()
+
+	logf("HTTP upload: receiving %v (%d bytes)\n", oid, size)
+	if err := receivePartial(req.Body, oid, size, 0, s.store, s.config, req.path); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logf("HTTP upload: content for %v received\n", oid)
+	recordUpload(s.config, req.user, req.path, oid, size)
+}
+
+func (s *httpServer) verify(w http.ResponseWriter, req *httpRequest) {
+	obj := httpBatchObject{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, httpMaxJSONBody)).Decode(&obj); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("Invalid verify request: %v", err.Error()))
+		return
+	}
+	oid := pathpkg.Base(strings.TrimSuffix(req.URL.Path, "/verify"))
+	stored, err := s.store.Size(req.path, oid)
+	if err != nil {
+		httpError(w, http.StatusNotFound, fmt.Sprintf("Object %v does not exist", oid))
+		return
+	}
+	if stored != obj.Size {
+		httpError(w, http.StatusConflict, sizeConflictMessage(oid, stored, obj.Size))
+		return
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP API", func() {
+
+	var config *Config
+	var repopath string
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+		config.AuthSecret = "sssh"
+		store, _ := NewStore(config)
+		server = httptest.NewServer(newHTTPHandler(config, store))
+		config.HTTPURL = server.URL
+	})
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(config.BasePath)
+	})
+
+	authenticate := func(operation string, user *User) *AuthenticateResponse {
+		var out bytes.Buffer
+		Expect(runAuthenticate(config, user, repopath, operation, &out)).To(BeZero())
+		resp := &AuthenticateResponse{}
+		Expect(json.Unmarshal(out.Bytes(), resp)).To(Succeed())
+		return resp
+	}
+	request := func(method, href string, header map[string]string, body []byte) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, href, bytes.NewReader(body))
+		Expect(err).To(BeNil())
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(resp.Body)
+		return resp, content
+	}
+	batch := func(auth *AuthenticateResponse, operation string, objects ...*httpBatchObject) (*http.Response, *httpBatchResponse) {
+		body, _ := json.Marshal(&httpBatchRequest{Operation: operation, Transfers: []string{"basic"}, Objects: objects})
+		resp, content := request("POST", auth.Href+"/objects/batch", auth.Header, body)
+		result := &httpBatchResponse{}
+		json.Unmarshal(content, result)
+		return resp, result
+	}
+
+	It("Issues tokens with git-lfs-authenticate", func() {
+		auth := authenticate(transferUpload, &User{Name: "alice"})
+		Expect(auth.Href).To(Equal(server.URL + "/test/repo"))
+		Expect(auth.Header["Authorization"]).To(HavePrefix("Bearer "))
+		expires, err := time.Parse(time.RFC3339, auth.ExpiresAt)
+		Expect(err).To(BeNil())
+		Expect(expires).To(BeTemporally("~", time.Now().Add(config.AuthTokenExpiry), 2*time.Second))
+
+		token, err := verifyToken(config.AuthSecret, strings.TrimPrefix(auth.Header["Authorization"], "Bearer "), time.Now())
+		Expect(err).To(BeNil())
+		Expect(token.User).To(Equal("alice"))
+		Expect(token.Path).To(Equal("test/repo"))
+		_, err = verifyToken(config.AuthSecret, strings.TrimPrefix(auth.Header["Authorization"], "Bearer "), expires.Add(time.Second))
+		Expect(err.Error()).To(ContainSubstring("expired"))
+		_, err = verifyToken("other secret", strings.TrimPrefix(auth.Header["Authorization"], "Bearer "), time.Now())
+		Expect(err.Error()).To(ContainSubstring("signature"))
+
+		config.AccessRules = []*AccessRule{{Users: []string{"*"}, Paths: []string{"**"}, Permission: PermissionRead}}
+		Expect(runAuthenticate(config, &User{Name: "carol"}, repopath, transferUpload, ioutil.Discard)).To(Equal(20), "Read-only users can't upload")
+		config.AuthSecret = ""
+		Expect(runAuthenticate(config, &User{Name: "carol"}, repopath, transferDownload, ioutil.Discard)).To(Equal(26))
+	})
+
+	It("Uploads and downloads objects", func() {
+		content := []byte(strings.Repeat("content sent over HTTP ", 1000))
+		oid := oidFor(content)
+		missing := oidFor([]byte("missing"))
+		auth := authenticate(transferUpload, &User{Name: "alice"})
+
+		resp, result := batch(auth, "upload", &httpBatchObject{Oid: oid, Size: int64(len(content))})
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(result.Transfer).To(Equal("basic"))
+		upload := result.Objects[0].Actions["upload"]
+		Expect(upload).ToNot(BeNil(), "Missing object should be uploaded")
+		Expect(upload.Href).To(Equal(auth.Href + "/objects/" + oid))
+
+		resp, _ = request("PUT", upload.Href, upload.Header, content)
+		Expect(resp.StatusCode).To(Equal(200), "Upload should succeed")
+		filename, _ := mediaPath(oid, config, repopath)
+		stored, _ := ioutil.ReadFile(filename)
+		Expect(stored).To(Equal(content), "Content should be stored")
+
+		verify := result.Objects[0].Actions["verify"]
+		body, _ := json.Marshal(&httpBatchObject{Oid: oid, Size: int64(len(content))})
+		resp, _ = request("POST", verify.Href, verify.Header, body)
+		Expect(resp.StatusCode).To(Equal(200), "Uploaded object should verify")
+
+		resp, result = batch(auth, "upload", &httpBatchObject{Oid: oid, Size: int64(len(content))})
+		Expect(result.Objects[0].Actions).To(BeEmpty(), "Existing objects needn't be uploaded")
+
+		bad := []byte("this doesn't match the oid")
+		resp, msg := request("PUT", auth.Href+"/objects/"+missing, auth.Header, bad)
+		Expect(resp.StatusCode).To(Equal(400), "Bad content should be rejected")
+		Expect(string(msg)).To(ContainSubstring("failed verification"))
+
+		down := authenticate(transferDownload, &User{Name: "alice"})
+		resp, result = batch(down, "download", &httpBatchObject{Oid: oid, Size: int64(len(content))}, &httpBatchObject{Oid: missing, Size: 7})
+		Expect(resp.StatusCode).To(Equal(200))
+		download := result.Objects[0].Actions["download"]
+		Expect(download).ToNot(BeNil())
+		Expect(result.Objects[1].Error.Code).To(Equal(404))
+
+		resp, received := request("GET", download.Href, download.Header, nil)
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(received).To(Equal(content), "Should receive the content")
+		resp, received = request("GET", download.Href, map[string]string{"Authorization": download.Header["Authorization"], "Range": "bytes=0-6"}, nil)
+		Expect(resp.StatusCode).To(Equal(206))
+		Expect(string(received)).To(Equal("content"))
+	})
+
+	It("Serves hrefs under the path of http-url", func() {
+		config.HTTPURL = server.URL + "/lfs/"
+		content := []byte("content behind a proxy")
+		oid := oidFor(content)
+		auth := authenticate(transferUpload, &User{Name: "alice"})
+		Expect(auth.Href).To(Equal(server.URL + "/lfs/test/repo"))
+
+		resp, result := batch(auth, "upload", &httpBatchObject{Oid: oid, Size: int64(len(content))})
+		Expect(resp.StatusCode).To(Equal(200), "Path of http-url shouldn't be taken as part of the repo path")
+		upload := result.Objects[0].Actions["upload"]
+		Expect(upload.Href).To(Equal(auth.Href + "/objects/" + oid))
+		resp, _ = request("PUT", upload.Href, upload.Header, content)
+		Expect(resp.StatusCode).To(Equal(200), "Upload should succeed")
+		filename, _ := mediaPath(oid, config, repopath)
+		_, err := os.Stat(filename)
+		Expect(err).To(BeNil(), "Content should be stored for the repo path")
+
+		resp, _ = request("GET", server.URL+"/test/repo/objects/"+oid, auth.Header, nil)
+		Expect(resp.StatusCode).To(Equal(404), "Requests outside http-url aren't served")
+	})
+
+	It("Refuses uploads over quota per object", func() {
+		config.Quotas = []*Quota{{Name: "test", Paths: []string{"test/*"}, Limit: 100}}
+		auth := authenticate(transferUpload, &User{Name: "alice"})
+		resp, result := batch(auth, "upload",
+			&httpBatchObject{Oid: oidFor([]byte("one")), Size: 60},
+			&httpBatchObject{Oid: oidFor([]byte("two")), Size: 60})
+		Expect(resp.StatusCode).To(Equal(200), "Objects over quota shouldn't fail the whole batch")
+		Expect(result.Objects[0].Actions["upload"]).ToNot(BeNil(), "Objects which fit should still be uploaded")
+		Expect(result.Objects[1].Actions).To(BeEmpty())
+		Expect(result.Objects[1].Error.Code).To(Equal(413))
+		Expect(result.Objects[1].Error.Message).To(ContainSubstring("'test' quota"))
+	})
+
+	It("Checks tokens", func() {
+		content := []byte("some content")
+		oid := oidFor(content)
+		down := authenticate(transferDownload, &User{Name: "alice"})
+
+		resp, _ := request("PUT", down.Href+"/objects/"+oid, nil, content)
+		Expect(resp.StatusCode).To(Equal(401), "Requests need a token")
+		resp, _ = request("PUT", down.Href+"/objects/"+oid, map[string]string{"Authorization": "Bearer nonsense"}, content)
+		Expect(resp.StatusCode).To(Equal(401))
+		resp, msg := request("PUT", down.Href+"/objects/"+oid, down.Header, content)
+		Expect(resp.StatusCode).To(Equal(403), "Download tokens can't upload")
+		Expect(string(msg)).To(ContainSubstring("only allows download"))
+		resp, _ = batch(down, "upload", &httpBatchObject{Oid: oid, Size: int64(len(content))})
+		Expect(resp.StatusCode).To(Equal(403))
+
+		resp, _ = request("GET", fmt.Sprintf("%v/other/repo/objects/%v", server.URL, oid), down.Header, nil)
+		Expect(resp.StatusCode).To(Equal(403), "Tokens are only valid for their path")
+		resp, _ = request("GET", server.URL+"/test/repo/../../../objects/"+oid, down.Header, nil)
+		Expect(resp.StatusCode).ToNot(Equal(200))
+
+		config.AccessRules = []*AccessRule{{Users: []string{"bob"}, Paths: []string{"**"}, Permission: PermissionRead}}
+		resp, _ = request("GET", down.Href+"/objects/"+oid, down.Header, nil)
+		Expect(resp.StatusCode).To(Equal(403), "Permission is checked again when the token is used")
+	})
+
+	It("Limits the size of batch requests", func() {
+		auth := authenticate(transferDownload, &User{Name: "alice"})
+		var objects []*httpBatchObject
+		for i := 0; i <= httpMaxBatchObjects; i++ {
+			objects = append(objects, &httpBatchObject{Oid: oidFor([]byte(fmt.Sprintf("%d", i))), Size: 1})
+		}
+		resp, _ := batch(auth, "download", objects...)
+		Expect(resp.StatusCode).To(Equal(413), "Too many objects should be refused")
+
+		huge := append([]byte(`{"operation": "download", "objects": [], "padding": "`), bytes.Repeat([]byte("x"), httpMaxJSONBody)...)
+		resp, _ = request("POST", auth.Href+"/objects/batch", auth.Header, append(huge, []byte(`"}`)...))
+		Expect(resp.StatusCode).To(Equal(400), "Huge bodies should be refused")
+	})
+})
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every connection is a separate process, so concurrent uploads of the same oid
+// are serialised with a lock file in the staging area which is created exclusively.
+// The lock records the pid & host of its holder and is touched regularly while the
+// upload is in progress, so that a lock left behind by a crashed process can be
+// recognised and reclaimed.
+
+// A lock whose holder hasn't touched it for this long is considered abandoned
+var uploadLockStaleAge = 2 * time.Minute
+
+// How often to check a lock held by someone else while waiting for it
+var uploadLockPollInterval = 250 * time.Millisecond
+
+type uploadLock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+func uploadLockPath(oid string, config *Config, path string) string {
+	return filepath.Join(stagingDir(config, path), oid+".lock")
+}
+
+// Take the upload lock for oid before its content is accepted. If another connection
+// is already uploading it, wait up to the configured timeout for that to finish.
+// exists is true (and lock nil) if the content arrived in the store in the meantime.
+// When repairing, the stored content is being replaced, so exists is always false.
+func lockUpload(oid string, store Store, config *Config, path string, repair bool) (lock *uploadLock, exists bool, err error) {
+	lockpath := uploadLockPath(oid, config, path)
+	err = ensureDirExists(filepath.Dir(lockpath), config)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to create staging directory: %v", err.Error())
+	}
+	deadline := time.Now().Add(config.UploadLockTimeout)
+	for {
+		lock, err = tryLockUpload(lockpath)
+		if err != nil {
+			return nil, false, err
+		}
+		// Either way, whoever had the lock may have just finished
+		if !repair && objectExists(store, path, oid) {
+			if lock != nil {
+				lock.release()
+			}
+			return nil, true, nil
+		}
+		if lock != nil {
+			return lock, false, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, false, fmt.Errorf("Upload of %v is already in progress on another connection, try again later", oid)
+		}
+		time.Sleep(uploadLockPollInterval)
+	}
+}
+
+// Take a lock file, waiting up to timeout if someone else holds it. Returns a
+// nil lock without error if it's still held when the timeout passes.
+func waitForLock(lockpath string, timeout time.Duration) (*uploadLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := tryLockUpload(lockpath)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+		if time.Now().After(deadline) {
+			return nil, nil
+		}
+		time.Sleep(uploadLockPollInterval)
+	}
+}
+
+// Try once to create the lock file, reclaiming it if its holder has gone
+// Returns a nil lock without error if it's legitimately held by someone else
+func tryLockUpload(lockpath string) (*uploadLock, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(lockpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			host, _ := os.Hostname()
+			fmt.Fprintf(f, "%d %v %d\n", os.Getpid(), host, time.Now().UnixNano())
+			f.Close()
+			l := &uploadLock{path: lockpath, stop: make(chan struct{}), done: make(chan struct{})}
+			go l.keepAlive()
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Unable to create upload lock: %v", err.Error())
+		}
+		held, err := ioutil.ReadFile(lockpath)
+		if err != nil {
+			// Released between our attempts, try again
+			continue
+		}
+		if !uploadLockIsStale(lockpath, held) || !reclaimUploadLock(lockpath, held) {
+			return nil, nil
+		}
+		logf("Reclaimed abandoned upload lock %v (%v)\n", lockpath, strings.TrimSpace(string(held)))
+	}
+	return nil, nil
+}
+
+func uploadLockIsStale(lockpath string, held []byte) bool {
+	s, err := os.Stat(lockpath)
+	if err != nil {
+		return false
+	}
+	if time.Since(s.ModTime()) > uploadLockStaleAge {
+		return true
+	}
+	// If the holder was on this host we can tell straight away whether it has died
+	fields := strings.Fields(string(held))
+	if len(fields) < 2 {
+		return false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	host, _ := os.Hostname()
+	if err != nil || fields[1] != host || pid == os.Getpid() {
+		return false
+	}
+	return !processAlive(pid)
+}
+
+func processAlive(pid int) bool {
+	if runtime.GOOS == "windows" {
+		// No way to probe without opening the process; rely on lock age instead
+		return true
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// Remove a stale lock such that if several processes try to reclaim it at once,
+// only one succeeds and none of them removes a fresh lock taken by another
+func reclaimUploadLock(lockpath string, held []byte) bool {
+	aside := fmt.Sprintf("%v.stale.%d", lockpath, os.Getpid())
+	if err := os.Rename(lockpath, aside); err != nil {
+		return false
+	}
+	moved, err := ioutil.ReadFile(aside)
+	ok := err == nil && bytes.Equal(moved, held)
+	if !ok {
+		// Someone else reclaimed it and locked it again before our rename, put theirs back
+		os.Link(aside, lockpath)
+	}
+	os.Remove(aside)
+	return ok
+}
+
+// Touch the lock file while the upload is in progress so it isn't treated as stale
+func (l *uploadLock) keepAlive() {
+	defer close(l.done)
+	ticker := time.NewTicker(uploadLockStaleAge / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+func (l *uploadLock) release() {
+	close(l.stop)
+	<-l.done
+	os.Remove(l.path)
+}
+
+// Whether another connection is currently uploading oid
+func uploadInProgress(oid string, config *Config, path string) bool {
+	lockpath := uploadLockPath(oid, config, path)
+	held, err := ioutil.ReadFile(lockpath)
+	if err != nil {
+		return false
+	}
+	return !uploadLockIsStale(lockpath, held)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Concurrent uploads", func() {
+
+	var config *Config
+	var repopath string
+	var content []byte
+	var oid string
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		config.UploadLockTimeout = 5 * time.Second
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+		content = make([]byte, 10000)
+		for i := range content {
+			content[i] = byte(i * 7)
+		}
+		oid = oidFor(content)
+	})
+	AfterEach(func() {
+		os.RemoveAll(config.BasePath)
+	})
+
+	connect := func() (net.Conn, *bufio.Reader) {
+		cli, srv := net.Pipe()
+		go Serve(srv, srv, ioutil.Discard, config, repopath, nil)
+		return cli, bufio.NewReader(cli)
+	}
+	writeLock := func(pid int, host string, modtime time.Time) {
+		lockpath := uploadLockPath(oid, config, repopath)
+		os.MkdirAll(filepath.Dir(lockpath), 0755)
+		ioutil.WriteFile(lockpath, []byte(fmt.Sprintf("%d %v %d\n", pid, host, modtime.UnixNano())), 0644)
+		os.Chtimes(lockpath, modtime, modtime)
+	}
+	uploadAll := func() *lfs.JsonResponse {
+		cli, rdr := connect()
+		defer cli.Close()
+		sendRawRequest(cli, "Upload", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+		startresp := lfs.UploadResponse{}
+		resp := readRawResponse(rdr, &startresp)
+		if resp.Error != nil {
+			return resp
+		}
+		Expect(startresp.OkToSend).To(BeTrue(), "Server should want content")
+		cli.Write(content)
+		return readRawResponse(rdr, nil)
+	}
+
+	It("Makes a second uploader wait for the first", func() {
+		first, firstrdr := connect()
+		defer first.Close()
+		sendRawRequest(first, "Upload", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+		startresp := lfs.UploadResponse{}
+		readRawResponse(firstrdr, &startresp)
+		Expect(startresp.OkToSend).To(BeTrue(), "Server should want content from first uploader")
+		first.Write(content[:4000])
+
+		second, secondrdr := connect()
+		defer second.Close()
+		sendRawRequest(second, "UploadCheck", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+		check := UploadCheckResponse{}
+		readRawResponse(secondrdr, &check)
+		Expect(check.OkToSend).To(BeTrue(), "Content isn't in the store yet")
+		Expect(check.InProgress).To(BeTrue(), "Should report the upload in progress")
+
+		secondstart := make(chan lfs.UploadResponse)
+		go func() {
+			sendRawRequest(second, "Upload", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+			r := lfs.UploadResponse{}
+			readRawResponse(secondrdr, &r)
+			secondstart <- r
+		}()
+		Consistently(secondstart, 500*time.Millisecond).ShouldNot(Receive(), "Second upload should wait")
+
+		first.Write(content[4000:])
+		complete := lfs.UploadCompleteResponse{}
+		readRawResponse(firstrdr, &complete)
+		Expect(complete.ReceivedOk).To(BeTrue(), "First upload should complete")
+
+		var r lfs.UploadResponse
+		Eventually(secondstart, 2*time.Second).Should(Receive(&r))
+		Expect(r.OkToSend).To(BeFalse(), "Second uploader should be told the content has arrived")
+		_, err := os.Stat(uploadLockPath(oid, config, repopath))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Lock should have been released")
+	})
+
+	It("Gives up waiting for an upload in progress", func() {
+		config.UploadLockTimeout = 300 * time.Millisecond
+		host, _ := os.Hostname()
+		writeLock(os.Getppid(), host, time.Now())
+		resp := uploadAll()
+		Expect(resp.Error).To(ContainSubstring("already in progress"), "Should refuse while another process holds the lock")
+	})
+
+	It("Reclaims locks left by a crashed process", func() {
+		host, _ := os.Hostname()
+		// A pid which can't be running
+		writeLock(1<<30, host, time.Now())
+		resp := uploadAll()
+		Expect(resp.Error).To(BeNil(), "Should take over a lock whose holder has died")
+		filename, _ := mediaPath(oid, config, repopath)
+		stored, err := ioutil.ReadFile(filename)
+		Expect(err).To(BeNil(), "Object should be in the store")
+		Expect(bytes.Equal(stored, content)).To(BeTrue(), "Object should have the correct content")
+	})
+
+	It("Reclaims locks which haven't been touched for too long", func() {
+		writeLock(1234, "some-other-host", time.Now().Add(-2*uploadLockStaleAge))
+		resp := uploadAll()
+		Expect(resp.Error).To(BeNil(), "Should take over a stale lock from another host")
+		_, err := os.Stat(uploadLockPath(oid, config, repopath))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Lock should have been released")
+	})
+})
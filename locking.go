@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io"
+	"io/ioutil"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File locking, modelled on the git-lfs locking API, so that users can claim
+// files which can't be merged before editing them.
+//
+// The locks for a repo path are kept as JSON in a .locks directory in the base
+// path. Each connection is a separate process, so changes are made while holding
+// an exclusive lock file, the same way as for uploads, and the new state is
+// renamed into place so readers never see a partial file.
+
+const locksDirName = ".locks"
+
+// How many locks LockList & LockVerify return at once by default
+const defaultLockListLimit = 100
+
+type FileLock struct {
+	Id       string     `json:"id"`
+	Path     string     `json:"path"`
+	LockedAt time.Time  `json:"locked_at"`
+	Owner    *LockOwner `json:"owner,omitempty"`
+}
+
+type LockOwner struct {
+	Name string `json:"name"`
+}
+
+type LockCreateRequest struct {
+	Path string   `json:"path"`
+	Ref  *LockRef `json:"ref,omitempty"`
+}
+type LockCreateResponse struct {
+	Lock *FileLock `json:"lock"`
+}
+type LockListRequest struct {
+	Path   string   `json:"path,omitempty"`
+	Id     string   `json:"id,omitempty"`
+	Cursor string   `json:"cursor,omitempty"`
+	Limit  int      `json:"limit,omitempty"`
+	Ref    *LockRef `json:"ref,omitempty"`
+}
+type LockListResponse struct {
+	Locks      []*FileLock `json:"locks"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+type LockDeleteRequest struct {
+	Id    string   `json:"id"`
+	Force bool     `json:"force,omitempty"`
+	Ref   *LockRef `json:"ref,omitempty"`
+}
+type LockDeleteResponse struct {
+	Lock *FileLock `json:"lock"`
+}
+type LockVerifyRequest struct {
+	Cursor string   `json:"cursor,omitempty"`
+	Limit  int      `json:"limit,omitempty"`
+	Ref    *LockRef `json:"ref,omitempty"`
+}
+type LockVerifyResponse struct {
+	// Locks held by this user, and by everyone else
+	Ours       []*FileLock `json:"ours"`
+	Theirs     []*FileLock `json:"theirs"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// Locks aren't per ref, but clients may send the ref they're working on
+type LockRef struct {
+	Name string `json:"name"`
+}
+
+// Why a lock operation couldn't be done, as the HTTP-style status the locking API
+// uses; Lock is the lock concerned, if there is one
+type lockError struct {
+	Code    int
+	Message string
+	Lock    *FileLock
+}
+
+func (e *lockError) Error() string {
+	return e.Message
+}
+
+func locksFilePath(config *Config, path string) string {
+	return filepath.Join(config.BasePath, locksDirName, path, "locks.json")
+}
+
+// Locks are on paths within the repo, always with forward slashes
+func cleanLockPath(p string) (string, error) {
+	clean := pathpkg.Clean(toSlash(strings.TrimSpace(p)))
+	if clean == "." || clean == "/" || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path to lock '%v'", p)
+	}
+	return strings.TrimPrefix(clean, "/"), nil
+}
+
+func readLocks(config *Config, path string) ([]*FileLock, error) {
+	content, err := ioutil.ReadFile(locksFilePath(config, path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var locks []*FileLock
+	if err := json.Unmarshal(content, &locks); err != nil {
+		return nil, fmt.Errorf("Unable to read locks: %v", err.Error())
+	}
+	return locks, nil
+}
+
+// Change the locks for a repo path; fn gets the current locks and returns the
+// new ones, or an error to leave them alone
+func updateLocks(config *Config, path string, fn func(locks []*FileLock) ([]*FileLock, error)) error {
+	filename := locksFilePath(config, path)
+	if err := ensureDirExists(filepath.Dir(filename), config); err != nil {
+		return fmt.Errorf("Unable to create locks directory: %v", err.Error())
+	}
+	held, err := waitForLock(filename+".lock", config.UploadLockTimeout)
+	if err != nil {
+		return err
+	}
+	if held == nil {
+		return fmt.Errorf("Locks for %v are being changed by another connection, try again later", path)
+	}
+	defer held.release()
+
+	locks, err := readLocks(config, path)
+	if err != nil {
+		return err
+	}
+	locks, err = fn(locks)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempf, err := ioutil.TempFile(filepath.Dir(filename), "templocks")
+	if err != nil {
+		return fmt.Errorf("Unable to write locks: %v", err.Error())
+	}
+	_, err = tempf.Write(content)
+	if cerr := tempf.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tempf.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tempf.Name())
+		return fmt.Errorf("Unable to write locks: %v", err.Error())
+	}
+	return nil
+}
+
+func newLockId() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Lock a file for u. If it's already locked the error is a lockError with the
+// existing lock.
+func createLock(config *Config, path, file string, u *User) (*FileLock, error) {
+	if u == nil || u.Name == "" {
+		return nil, &lockError{Code: 403, Message: "Locking needs a user name"}
+	}
+	file, err := cleanLockPath(file)
+	if err != nil {
+		return nil, &lockError{Code: 400, Message: err.Error()}
+	}
+	lock := &FileLock{Id: newLockId(), Path: file, LockedAt: time.Now().UTC().Truncate(time.Second), Owner: &LockOwner{Name: u.Name}}
+	err = updateLocks(config, path, func(locks []*FileLock) ([]*FileLock, error) {
+		for _, l := range locks {
+			if l.Path == file {
+				return nil, &lockError{Code: 409, Message: fmt.Sprintf("%v is already locked by %v", file, l.Owner.Name), Lock: l}
+			}
+		}
+		return append(locks, lock), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logf("Locked %v for %v\n", file, u)
+	return lock, nil
+}
+
+// Remove a lock; only its owner can unless force is set, which needs admin
+// permission if access rules are configured, like the admin subcommands
+func deleteLock(config *Config, path, id string, force bool, u *User) (*FileLock, error) {
+	if force && len(config.AccessRules) > 0 && config.PermissionFor(u, path) < PermissionAdmin {
+		return nil, &lockError{Code: 403, Message: fmt.Sprintf("Permission denied: %v needs admin access to %v to force unlock", u, path)}
+	}
+	var deleted *FileLock
+	err := updateLocks(config, path, func(locks []*FileLock) ([]*FileLock, error) {
+		for i, l := range locks {
+			if l.Id != id {
+				continue
+			}
+			if !force && (u == nil || l.Owner.Name != u.Name) {
+				return nil, &lockError{Code: 403, Message: fmt.Sprintf("%v is locked by %v", l.Path, l.Owner.Name), Lock: l}
+			}
+			deleted = l
+			return append(locks[:i], locks[i+1:]...), nil
+		}
+		return nil, &lockError{Code: 404, Message: fmt.Sprintf("Lock %v does not exist", id)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	logf("Unlocked %v for %v (force: %v)\n", deleted.Path, u, force)
+	return deleted, nil
+}
+
+// Locks matching file and/or id (if given), a page at a time; the cursor is the
+// id of the first lock to return
+func listLocks(config *Config, path, file, id, cursor string, limit int) (page []*FileLock, next string, err error) {
+	locks, err := readLocks(config, path)
+	if err != nil {
+		return nil, "", err
+	}
+	if file != "" {
+		if file, err = cleanLockPath(file); err != nil {
+			return nil, "", &lockError{Code: 400, Message: err.Error()}
+		}
+	}
+	if limit <= 0 {
+		limit = defaultLockListLimit
+	}
+	started := cursor == ""
+	for _, l := range locks {
+		if !started && l.Id == cursor {
+			started = true
+		}
+		if !started || (file != "" && l.Path != file) || (id != "" && l.Id != id) {
+			continue
+		}
+		if len(page) == limit {
+			return page, l.Id, nil
+		}
+		page = append(page, l)
+	}
+	if !started {
+		return nil, "", &lockError{Code: 400, Message: fmt.Sprintf("Invalid cursor '%v'", cursor)}
+	}
+	return page, "", nil
+}
+
+// Split locks into those owned by u and the rest
+func partitionLocks(locks []*FileLock, u *User) (ours, theirs []*FileLock) {
+	ours, theirs = []*FileLock{}, []*FileLock{}
+	for _, l := range locks {
+		if u != nil && l.Owner.Name == u.Name {
+			ours = append(ours, l)
+		} else {
+			theirs = append(theirs, l)
+		}
+	}
+	return ours, theirs
+}
+
+// Error response for a lock method, which includes the lock concerned as the
+// result as the locking API does
+func lockErrorResponse(id int, err error) *lfs.JsonResponse {
+	if lerr, ok := err.(*lockError); ok && lerr.Lock != nil {
+		if resp, rerr := lfs.NewJsonResponse(id, &LockCreateResponse{Lock: lerr.Lock}); rerr == nil {
+			resp.Error = err.Error()
+			return resp
+		}
+	}
+	return lfs.NewJsonErrorResponse(id, err.Error())
+}
+
+func lockCreate(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	lockreq := LockCreateRequest{}
+	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &lockreq)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	lock, err := createLock(config, path, lockreq.Path, sess.User)
+	if err != nil {
+		logf("LockCreate %d: %v\n", req.Id, err.Error())
+		return lockErrorResponse(req.Id, err)
+	}
+	resp, err := lfs.NewJsonResponse(req.Id, &LockCreateResponse{Lock: lock})
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func lockList(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	listreq := LockListRequest{}
+	// Params are optional, to list everything
+	if req.Params != nil {
+		if err := lfs.ExtractStructFromJsonRawMessage(req.Params, &listreq); err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+	}
+	locks, next, err := listLocks(config, path, listreq.Path, listreq.Id, listreq.Cursor, listreq.Limit)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	if locks == nil {
+		locks = []*FileLock{}
+	}
+	resp, err := lfs.NewJsonResponse(req.Id, &LockListResponse{Locks: locks, NextCursor: next})
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func lockDelete(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	delreq := LockDeleteRequest{}
+	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &delreq)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	lock, err := deleteLock(config, path, delreq.Id, delreq.Force, sess.User)
+	if err != nil {
+		logf("LockDelete %d: %v\n", req.Id, err.Error())
+		return lockErrorResponse(req.Id, err)
+	}
+	resp, err := lfs.NewJsonResponse(req.Id, &LockDeleteResponse{Lock: lock})
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func lockVerify(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	verreq := LockVerifyRequest{}
+	if req.Params != nil {
+		if err := lfs.ExtractStructFromJsonRawMessage(req.Params, &verreq); err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+	}
+	locks, next, err := listLocks(config, path, "", "", verreq.Cursor, verreq.Limit)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	ours, theirs := partitionLocks(locks, sess.User)
+	resp, err := lfs.NewJsonResponse(req.Id, &LockVerifyResponse{Ours: ours, Theirs: theirs, NextCursor: next})
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("File locking", func() {
+
+	var config *Config
+	var repopath string
+	var conns []net.Conn
+	var dones []chan int
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+		conns, dones = nil, nil
+	})
+	AfterEach(func() {
+		for i, cli := range conns {
+			cli.Close()
+			<-dones[i]
+		}
+		os.RemoveAll(config.BasePath)
+	})
+
+	// Start a session for a user, returning a function to make requests with
+	start := func(name string) func(method string, params, result interface{}) *lfs.JsonResponse {
+		cli, srv := net.Pipe()
+		done := make(chan int, 1)
+		go func() {
+			done <- Serve(srv, srv, GinkgoWriter, config, repopath, &User{Name: name})
+			srv.Close()
+		}()
+		conns, dones = append(conns, cli), append(dones, done)
+		rdr := bufio.NewReader(cli)
+		return func(method string, params, result interface{}) *lfs.JsonResponse {
+			sendRawRequest(cli, method, params)
+			return readRawResponse(rdr, result)
+		}
+	}
+
+	It("Locks and unlocks files", func() {
+		alice := start("alice")
+		bob := start("bob")
+
+		created := LockCreateResponse{}
+		resp := alice("LockCreate", &LockCreateRequest{Path: "art/hero.psd"}, &created)
+		Expect(resp.Error).To(BeNil(), "Should be able to lock a file")
+		Expect(created.Lock.Path).To(Equal("art/hero.psd"))
+		Expect(created.Lock.Owner.Name).To(Equal("alice"))
+
+		resp = bob("LockCreate", &LockCreateRequest{Path: "./art/hero.psd"}, nil)
+		Expect(resp.Error).To(ContainSubstring("already locked by alice"), "Files can only be locked once")
+		existing := LockCreateResponse{}
+		lfs.ExtractStructFromJsonRawMessage(resp.Result, &existing)
+		Expect(existing.Lock.Id).To(Equal(created.Lock.Id), "Conflict should describe the existing lock")
+
+		for i := 0; i < 2; i++ {
+			resp = alice("LockCreate", &LockCreateRequest{Path: fmt.Sprintf("art/level%d.psd", i)}, nil)
+			Expect(resp.Error).To(BeNil())
+		}
+		list := LockListResponse{}
+		bob("LockList", &LockListRequest{Limit: 2}, &list)
+		Expect(list.Locks).To(HaveLen(2))
+		Expect(list.NextCursor).ToNot(BeEmpty(), "Locks should be paged")
+		bob("LockList", &LockListRequest{Cursor: list.NextCursor}, &list)
+		Expect(list.Locks).To(HaveLen(1))
+		Expect(list.Locks[0].Path).To(Equal("art/level1.psd"))
+		bob("LockList", &LockListRequest{Path: "art/hero.psd"}, &list)
+		Expect(list.Locks).To(HaveLen(1))
+		Expect(list.Locks[0].Id).To(Equal(created.Lock.Id))
+
+		verify := LockVerifyResponse{}
+		bob("LockVerify", &LockVerifyRequest{Ref: &LockRef{Name: "refs/heads/main"}}, &verify)
+		Expect(verify.Ours).To(BeEmpty())
+		Expect(verify.Theirs).To(HaveLen(3))
+		alice("LockVerify", &LockVerifyRequest{}, &verify)
+		Expect(verify.Ours).To(HaveLen(3))
+
+		resp = bob("LockDelete", &LockDeleteRequest{Id: created.Lock.Id}, nil)
+		Expect(resp.Error).To(ContainSubstring("locked by alice"), "Only the owner can unlock")
+		deleted := LockDeleteResponse{}
+		resp = alice("LockDelete", &LockDeleteRequest{Id: created.Lock.Id}, &deleted)
+		Expect(resp.Error).To(BeNil())
+		Expect(deleted.Lock.Path).To(Equal("art/hero.psd"))
+		resp = alice("LockDelete", &LockDeleteRequest{Id: created.Lock.Id}, nil)
+		Expect(resp.Error).To(ContainSubstring("does not exist"))
+	})
+
+	It("Only lets admins force unlock", func() {
+		config.AccessRules = []*AccessRule{
+			{Users: []string{"alice", "bob"}, Paths: []string{"**"}, Permission: PermissionWrite},
+			{Users: []string{"carol"}, Paths: []string{"**"}, Permission: PermissionAdmin},
+		}
+		lock, err := createLock(config, repopath, "art/hero.psd", &User{Name: "alice"})
+		Expect(err).To(BeNil())
+
+		bob := start("bob")
+		resp := bob("LockDelete", &LockDeleteRequest{Id: lock.Id, Force: true}, nil)
+		Expect(resp.Error).To(ContainSubstring("needs admin access"))
+
+		carol := start("carol")
+		resp = carol("LockDelete", &LockDeleteRequest{Id: lock.Id, Force: true}, nil)
+		Expect(resp.Error).To(BeNil(), "Admins can unlock anyone's files")
+		locks, _ := readLocks(config, repopath)
+		Expect(locks).To(BeEmpty())
+	})
+
+	It("Lets anyone force unlock without access rules", func() {
+		lock, err := createLock(config, repopath, "art/hero.psd", &User{Name: "alice"})
+		Expect(err).To(BeNil())
+
+		bob := start("bob")
+		resp := bob("LockDelete", &LockDeleteRequest{Id: lock.Id}, nil)
+		Expect(resp.Error).To(ContainSubstring("is locked by alice"), "Force is still needed for others' locks")
+		resp = bob("LockDelete", &LockDeleteRequest{Id: lock.Id, Force: true}, nil)
+		Expect(resp.Error).To(BeNil(), "Everyone is an admin without access rules")
+		locks, _ := readLocks(config, repopath)
+		Expect(locks).To(BeEmpty())
+	})
+
+	It("Keeps every lock when they're created concurrently", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				createLock(config, repopath, fmt.Sprintf("file%d.bin", i), &User{Name: "alice"})
+			}(i)
+		}
+		wg.Wait()
+		locks, err := readLocks(config, repopath)
+		Expect(err).To(BeNil())
+		Expect(locks).To(HaveLen(20))
+	})
+})
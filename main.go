@@ -1,11 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"strings"
 )
 
 var (
@@ -30,7 +32,7 @@ func MainImpl() int {
 	defer func() {
 		if e := recover(); e != nil {
 			outputf("Panic: %v\n", e)
-			outputf(string(debug.Stack()))
+			outputf("%s", debug.Stack())
 			os.Exit(99)
 		}
 
@@ -68,18 +70,141 @@ func MainImpl() int {
 		}
 	}
 
-	// Get path argument
-	if len(os.Args) < 2 {
-		outputf("Path argument missing, cannot continue\n")
+	// Get arguments; a user name can be given when run as a forced command from
+	// authorized_keys, in which case the path comes from the original command
+	flags := flag.NewFlagSet("git-lfs-ssh-serve", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	username := flags.String("user", "", "Name of the SSH user to authorise as")
+	if err := flags.Parse(os.Args[1:]); err != nil {
 		return 18
 	}
-	repoPath = filepath.Clean(os.Args[1])
-	if filepath.IsAbs(repoPath) && !cfg.AllowAbsolutePaths {
-		outputf("Path argument %v invalid, absolute paths are not allowed by this server\n", repoPath)
+	// Current git-lfs clients run git-lfs-transfer, which can be a link to this,
+	// as can git-lfs-authenticate
+	program := programName(os.Args[0])
+	// Maintenance subcommands, run by an administrator rather than git-lfs. A git-lfs
+	// client only ever passes a single path, which may happen to have the same name,
+	// so over SSH a subcommand alone is still treated as a path.
+	if sub, ok := subcommands[flags.Arg(0)]; ok && program != transferProgram && program != authenticateProgram && (flags.NArg() > 1 || os.Getenv("SSH_CONNECTION") == "") {
+		return sub(cfg, IdentifyUser(*username, cfg), flags.Args()[1:], os.Stdout)
+	}
+
+	args := flags.Args()
+	if len(args) == 0 {
+		if origcmd := os.Getenv("SSH_ORIGINAL_COMMAND"); origcmd != "" {
+			program, args, err = parseOriginalCommand(origcmd)
+			if err != nil {
+				outputf("%v\n", err.Error())
+				return 18
+			}
+		} else {
+			outputf("Path argument missing, cannot continue\n")
+			return 18
+		}
+	}
+	patharg := args[0]
+	var operation string
+	if program == transferProgram {
+		if len(args) != 2 || (args[1] != transferUpload && args[1] != transferDownload) {
+			outputf("Usage: %v <path> <upload|download>\n", transferProgram)
+			return 18
+		}
+		operation = args[1]
+	}
+	if program == authenticateProgram {
+		// git-lfs also passes the oid of the first object, which isn't needed
+		if len(args) < 2 || len(args) > 3 || (args[1] != transferUpload && args[1] != transferDownload) {
+			outputf("Usage: %v <path> <upload|download> [oid]\n", authenticateProgram)
+			return 18
+		}
+		operation = args[1]
+	}
+	if filepath.IsAbs(filepath.FromSlash(toSlash(patharg))) && !cfg.AllowAbsolutePaths {
+		outputf("Path argument %v invalid, absolute paths are not allowed by this server\n", patharg)
 		return 18
 	}
+	repoPath, err = resolveRepoPath(cfg.BasePath, patharg)
+	if err != nil {
+		outputf("Path argument %v invalid: %v\n", patharg, err.Error())
+		return 19
+	}
+
+	user := IdentifyUser(*username, cfg)
+	if cfg.PermissionFor(user, repoPath) == PermissionNone {
+		outputf("Access denied, %v has no access to %v\n", user, repoPath)
+		return 20
+	}
 
-	return Serve(os.Stdin, os.Stdout, os.Stderr, cfg, repoPath)
+	if program == authenticateProgram {
+		return runAuthenticate(cfg, user, repoPath, operation, os.Stdout)
+	}
+	if program == transferProgram {
+		return ServeTransfer(os.Stdin, os.Stdout, os.Stderr, cfg, repoPath, operation, user)
+	}
+	return Serve(os.Stdin, os.Stdout, os.Stderr, cfg, repoPath, user)
+}
+
+// Clean up the path argument and check that the repo directory it refers to is
+// inside basePath, including once any symlinks are resolved. Returns the cleaned
+// path, which is still relative to basePath if it was to begin with.
+func resolveRepoPath(basePath, arg string) (string, error) {
+	// Clients may send Windows-style separators, treat them as separators everywhere
+	p := filepath.Clean(filepath.FromSlash(toSlash(strings.TrimSpace(arg))))
+	if p == "." || p == string(filepath.Separator) {
+		return "", fmt.Errorf("Path must not be empty")
+	}
+	// The server keeps its own data (.locks, .quota etc) in dot directories
+	for _, part := range strings.Split(toSlash(p), "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("Path components must not start with '.'")
+		}
+	}
+	// Absolute paths are still stored under the base path
+	full := filepath.Join(basePath, p)
+	if !pathIsInside(basePath, full) {
+		return "", fmt.Errorf("Path is outside of base-path")
+	}
+	realBase, err := filepath.EvalSymlinks(basePath)
+	if err != nil {
+		return "", err
+	}
+	realFull, err := evalSymlinksExisting(full)
+	if err != nil {
+		return "", err
+	}
+	if !pathIsInside(realBase, realFull) {
+		return "", fmt.Errorf("Path resolves to %v which is outside of base-path", realFull)
+	}
+	return p, nil
+}
+
+// Whether p is strictly inside dir (not dir itself); both must be clean
+func pathIsInside(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// Like filepath.EvalSymlinks but p doesn't have to exist; symlinks are resolved
+// in the part which does and the rest is appended
+func evalSymlinksExisting(p string) (string, error) {
+	var rest []string
+	for {
+		if _, err := os.Lstat(p); err == nil {
+			real, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return filepath.Join(append([]string{p}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
 }
 
 func dirExists(path string) bool {
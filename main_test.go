@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Repository path argument", func() {
+
+	var basepath string
+	var outside string
+
+	BeforeEach(func() {
+		basepath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		outside = filepath.Join(os.TempDir(), "git-lfs-serve-test-outside")
+		os.MkdirAll(filepath.Join(basepath, "team", "repo"), 0755)
+		os.MkdirAll(outside, 0755)
+	})
+	AfterEach(func() {
+		os.RemoveAll(basepath)
+		os.RemoveAll(outside)
+	})
+
+	It("Accepts paths inside the base path", func() {
+		p, err := resolveRepoPath(basepath, "team/repo")
+		Expect(err).To(BeNil())
+		Expect(p).To(Equal(filepath.Join("team", "repo")))
+		p, err = resolveRepoPath(basepath, "team/new/../repo2")
+		Expect(err).To(BeNil(), "Paths which don't exist yet are fine")
+		Expect(p).To(Equal(filepath.Join("team", "repo2")))
+		p, err = resolveRepoPath(basepath, `team\repo`)
+		Expect(err).To(BeNil())
+		Expect(p).To(Equal(filepath.Join("team", "repo")), "Windows separators should be understood")
+	})
+
+	It("Rejects paths which escape the base path", func() {
+		_, err := resolveRepoPath(basepath, "../../etc")
+		Expect(err).ToNot(BeNil(), "Parent directories should be refused")
+		_, err = resolveRepoPath(basepath, "team/../../etc")
+		Expect(err).ToNot(BeNil(), "Parent directories part way through should be refused")
+		_, err = resolveRepoPath(basepath, `..\..\etc`)
+		Expect(err).ToNot(BeNil(), "Parent directories with Windows separators should be refused")
+		_, err = resolveRepoPath(basepath, `team\..\..\etc`)
+		Expect(err).ToNot(BeNil(), "Parent directories with Windows separators should be refused")
+	})
+
+	It("Rejects empty paths", func() {
+		_, err := resolveRepoPath(basepath, "")
+		Expect(err).ToNot(BeNil())
+		_, err = resolveRepoPath(basepath, "  ")
+		Expect(err).ToNot(BeNil())
+		_, err = resolveRepoPath(basepath, "team/..")
+		Expect(err).ToNot(BeNil(), "Path which is the base path itself should be refused")
+	})
+
+	It("Rejects paths to the server's own directories", func() {
+		for _, p := range []string{".locks", ".quota/users", "team/.staging", `team\.deltacache`, "/.quarantine/repo"} {
+			_, err := resolveRepoPath(basepath, p)
+			Expect(err).ToNot(BeNil(), "%v should be refused", p)
+		}
+	})
+
+	It("Rejects symlinks out of the base path", func() {
+		Expect(os.Symlink(outside, filepath.Join(basepath, "team", "escape"))).To(Succeed())
+		_, err := resolveRepoPath(basepath, "team/escape")
+		Expect(err).ToNot(BeNil(), "Symlink out of base path should be refused")
+		_, err = resolveRepoPath(basepath, "team/escape/sub/repo")
+		Expect(err).ToNot(BeNil(), "Paths under a symlink out of base path should be refused")
+
+		// Symlinks which stay inside are fine
+		Expect(os.Symlink(filepath.Join(basepath, "team", "repo"), filepath.Join(basepath, "team", "alias"))).To(Succeed())
+		_, err = resolveRepoPath(basepath, "team/alias")
+		Expect(err).To(BeNil(), "Symlink within base path should be allowed")
+	})
+})
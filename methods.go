@@ -1,16 +1,44 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"hash"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+	"regexp"
 )
 
-func version(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *lfs.JsonResponse {
-	verresult := lfs.ServerVersionResponse{versionMajor, versionMinor, versionPatch}
+func version(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	verreq := VersionRequest{}
+	// Params are optional, older clients send none
+	if req.Params != nil {
+		err := lfs.ExtractStructFromJsonRawMessage(req.Params, &verreq)
+		if err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+	}
+	verresult := VersionResponse{Major: versionMajor, Minor: versionMinor, Patch: versionPatch,
+		Capabilities: supportedCapabilities(config), Encodings: supportedEncodings}
+	if sess.Framed {
+		// Requests are running concurrently by now, so the session can't change
+		verresult.Enabled = sess.enabledCapabilities()
+	} else if verreq.Capabilities != nil {
+		verresult.Enabled = sess.enableCapabilities(verreq.Capabilities, config)
+		logf("Version %d: enabled capabilities %v\n", req.Id, verresult.Enabled)
+	}
+	if verreq.Framing == framingMultiplex || sess.Capabilities[capabilityFraming] {
+		if !sess.Framed {
+			// Serve() switches once this response has been sent
+			sess.Framed = true
+		}
+		verresult.Framing = framingMultiplex
+	}
 	resp, err := lfs.NewJsonResponse(req.Id, verresult)
 	if err != nil {
 		return lfs.NewJsonErrorResponse(req.Id, err.Error())
@@ -18,22 +46,71 @@ func version(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config,
 	return resp
 }
 
-func upload(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *lfs.JsonResponse {
-	upreq := lfs.UploadRequest{}
+// Same as lfs.UploadRequest on the wire, plus optional compression of the content
+type EncodedUploadRequest struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+	// If set, the content is sent as EncodedSize bytes in this encoding
+	Encoding    string `json:"encoding,omitempty"`
+	EncodedSize int64  `json:"encodedSize,omitempty"`
+	// Replace the stored object if its size doesn't match, rather than reporting
+	// a conflict; see repair.go
+	Repair bool `json:"repair,omitempty"`
+}
+
+func upload(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	upreq := EncodedUploadRequest{}
 	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &upreq)
 	if err != nil {
 		return lfs.NewJsonErrorResponse(req.Id, err.Error())
 	}
 	logf("Upload %d: requested %v %d\n", req.Id, upreq.Oid, upreq.Size)
 	// Build destination path
-	filename, err := mediaPath(upreq.Oid, config, path)
-	if err != nil {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error determining media path. %v", err))
+	if resp := invalidOidResponse(req.Id, upreq.Oid); resp != nil {
+		return resp
+	}
+	if upreq.Encoding != "" {
+		if !sess.capabilityEnabled(capabilityCompression) {
+			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Compressed uploads need the '%v' capability, which was not enabled for this session", capabilityCompression))
+		}
+		if err := checkEncoding(upreq.Encoding); err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+		if upreq.EncodedSize <= 0 {
+			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Invalid encoded size %d", upreq.EncodedSize))
+		}
 	}
 	startresult := lfs.UploadResponse{}
-	_, staterr := os.Stat(filename)
-	if staterr != nil && os.IsNotExist(staterr) {
-		startresult.OkToSend = true
+	stored, staterr := sess.Store.Size(path, upreq.Oid)
+	repairing := staterr == nil && stored != upreq.Size
+	if repairing {
+		if !upreq.Repair {
+			return sizeConflictResponse(req.Id, upreq.Oid, stored, upreq.Size)
+		}
+		if resp := repairDeniedResponse(req.Id, config, path, sess); resp != nil {
+			return resp
+		}
+		if upreq.Size > stored {
+			// Only growth counts towards quotas
+			if err := checkQuota(config, sess.Store, sess.User, path, upreq.Size-stored); err != nil {
+				return lfs.NewJsonErrorResponse(req.Id, err.Error())
+			}
+		}
+		logf("Upload %d: repairing %v, stored with %d bytes\n", req.Id, upreq.Oid, stored)
+	} else if staterr != nil && os.IsNotExist(staterr) {
+		if err := checkQuota(config, sess.Store, sess.User, path, upreq.Size); err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+	}
+	if repairing || (staterr != nil && os.IsNotExist(staterr)) {
+		lock, exists, err := lockUpload(upreq.Oid, sess.Store, config, path, repairing)
+		if err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+		if lock != nil {
+			defer lock.release()
+		}
+		startresult.OkToSend = !exists
 	}
 	// Send start response immediately
 	resp, err := lfs.NewJsonResponse(req.Id, startresult)
@@ -51,49 +128,70 @@ func upload(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, p
 
 	logf("Upload %d: waiting for content %v\n", req.Id, upreq.Oid)
 	// Next from client should be byte stream of exactly the stated number of bytes
-	// Now open temp file to write to
-	tempf, err := ioutil.TempFile("", "tempupload")
-	defer os.Remove(tempf.Name())
-	defer tempf.Close()
-	n, err := io.CopyN(tempf, in, upreq.Size)
-	if err != nil {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unable to read data: %v", err.Error()))
-	} else if n != upreq.Size {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Received wrong number of bytes %d (expected %d)", n, upreq.Size))
-	}
-
 	receivedresult := lfs.UploadCompleteResponse{}
 	receivedresult.ReceivedOk = true
 	var receiveerr string
-	// force close now before defer so we can copy
-	err = tempf.Close()
+	content := in
+	if upreq.Encoding != "" {
+		logf("Upload %d: receiving %d bytes of %v content\n", req.Id, upreq.EncodedSize, upreq.Encoding)
+		var decoded *encodedReader
+		decoded, err = newEncodedReader(in, upreq.Encoding, upreq.EncodedSize)
+		if err == nil {
+			defer decoded.Close()
+			content = decoded
+		}
+	}
+	if err == nil {
+		err = receivePartial(content, upreq.Oid, upreq.Size, 0, sess.Store, config, path)
+	}
 	if err != nil {
 		receivedresult.ReceivedOk = false
-		receiveerr = fmt.Sprintf("Error when closing temp file: %v", err.Error())
-	} else {
-		// ensure final directory exists
-		ensureDirExists(filepath.Dir(filename), config)
-		// Move temp file to final location
-		err = os.Rename(tempf.Name(), filename)
-		if err != nil {
-			receivedresult.ReceivedOk = false
-			receiveerr = fmt.Sprintf("Error when closing temp file: %v", err.Error())
-		}
-
+		receiveerr = err.Error()
 	}
 
 	resp, _ = lfs.NewJsonResponse(req.Id, receivedresult)
 	if receiveerr != "" {
 		logf("Upload %d: error in content for %v: %v\n", req.Id, upreq.Oid, receiveerr)
 		resp.Error = receiveerr
+	} else if repairing {
+		logf("Upload %d: content for %v received, stored object repaired\n", req.Id, upreq.Oid)
+		recordRepair(config, sess.User, path, upreq.Oid, stored, upreq.Size)
+		// Deltas made from the damaged content are no good
+		removeCachedDeltas(config, path, upreq.Oid)
 	} else {
 		logf("Upload %d: content for %v received\n", req.Id, upreq.Oid)
+		recordUpload(config, sess.User, path, upreq.Oid, upreq.Size)
 	}
 
 	return resp
 
 }
 
+// Verify content received into tempf against the oid it's supposed to have and if
+// it matches, put it in the store. hasher must have been fed all the content
+// written to tempf. Nothing is stored if there's an error.
+func commitUpload(tempf *os.File, hasher hash.Hash, oid string, store Store, path string) error {
+	// Make sure content is on disk before it can be visible in the store, and
+	// force close now before defer so we can move
+	err := tempf.Sync()
+	if closeerr := tempf.Close(); err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		return fmt.Errorf("Error when closing temp file: %v", err.Error())
+	}
+	receivedoid := hex.EncodeToString(hasher.Sum(nil))
+	if receivedoid != oid {
+		// Content is corrupt or truncated, temp file is discarded by caller
+		return fmt.Errorf("Content failed verification, SHA-256 of received data is %v (expected %v)", receivedoid, oid)
+	}
+	err = importObject(store, path, oid, tempf.Name())
+	if err != nil {
+		return fmt.Errorf("Error when moving temp file to store: %v", err.Error())
+	}
+	return nil
+}
+
 func ensureDirExists(dir string, cfg *Config) error {
 	s, err := os.Stat(dir)
 	if err == nil {
@@ -112,7 +210,14 @@ func ensureDirExists(dir string, cfg *Config) error {
 	return nil
 }
 
-func uploadCheck(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *lfs.JsonResponse {
+// Same as lfs.UploadResponse on the wire, plus whether another connection is
+// uploading the same content right now, in which case an Upload will wait for it
+type UploadCheckResponse struct {
+	OkToSend   bool `json:"okToSend"`
+	InProgress bool `json:"inProgress,omitempty"`
+}
+
+func uploadCheck(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
 	upreq := lfs.UploadRequest{}
 	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &upreq)
 	if err != nil {
@@ -120,16 +225,22 @@ func uploadCheck(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Conf
 	}
 	logf("UploadCheck %d: %v %d requested\n", req.Id, upreq.Oid, upreq.Size)
 	// Build destination path
-	filename, err := mediaPath(upreq.Oid, config, path)
-	if err != nil {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error determining media path. %v", err))
+	if resp := invalidOidResponse(req.Id, upreq.Oid); resp != nil {
+		return resp
+	}
+	startresult := UploadCheckResponse{}
+	stored, staterr := sess.Store.Size(path, upreq.Oid)
+	if staterr == nil && stored != upreq.Size {
+		return sizeConflictResponse(req.Id, upreq.Oid, stored, upreq.Size)
 	}
-	startresult := lfs.UploadResponse{}
-	_, staterr := os.Stat(filename)
 	if staterr != nil && os.IsNotExist(staterr) {
+		if err := checkQuota(config, sess.Store, sess.User, path, upreq.Size); err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
 		startresult.OkToSend = true
+		startresult.InProgress = uploadInProgress(upreq.Oid, config, path)
 	}
-	logf("UploadCheck %d: OK to send %v? %v\n", req.Id, upreq.Oid, startresult.OkToSend)
+	logf("UploadCheck %d: OK to send %v? %v (in progress elsewhere: %v)\n", req.Id, upreq.Oid, startresult.OkToSend, startresult.InProgress)
 	// Send start response immediately
 	resp, err := lfs.NewJsonResponse(req.Id, startresult)
 	if err != nil {
@@ -139,22 +250,21 @@ func uploadCheck(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Conf
 
 }
 
-func downloadCheck(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *lfs.JsonResponse {
+func downloadCheck(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
 	downreq := lfs.DownloadCheckRequest{}
 	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &downreq)
 	if err != nil {
 		return lfs.NewJsonErrorResponse(req.Id, err.Error())
 	}
 	logf("DownloadCheck %d: %v requested\n", req.Id, downreq.Oid)
-	filename, err := mediaPath(downreq.Oid, config, path)
-	if err != nil {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Problem determining media path: %v", err))
+	if resp := invalidOidResponse(req.Id, downreq.Oid); resp != nil {
+		return resp
 	}
 	result := lfs.DownloadCheckResponse{}
-	s, err := os.Stat(filename)
+	size, err := sess.Store.Size(path, downreq.Oid)
 	if err == nil {
 		// file exists
-		result.Size = s.Size()
+		result.Size = size
 		logf("DownloadCheck %d: %v response size %d\n", req.Id, downreq.Oid, result.Size)
 	} else {
 		result.Size = -1
@@ -166,82 +276,274 @@ func downloadCheck(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Co
 	}
 	return resp
 }
-func download(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *lfs.JsonResponse {
-	downreq := lfs.DownloadRequest{}
+
+// Same as lfs.DownloadRequest on the wire, plus an optional range so that
+// interrupted downloads can be continued. Length 0 means up to the end.
+// If Chunked is set the content is sent in chunks followed by a JSON trailer,
+// so that errors part way can be reported without ending the session.
+type DownloadRangeRequest struct {
+	Oid     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Offset  int64  `json:"offset,omitempty"`
+	Length  int64  `json:"length,omitempty"`
+	Chunked bool   `json:"chunked,omitempty"`
+	// Compression to use for chunked content if it's worthwhile
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Sent after the last chunk of a chunked download if all the content was sent
+type DownloadTrailer struct {
+	// Number of bytes sent, and the SHA-256 of them in lower case hex; both
+	// are for the uncompressed content if it was encoded
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+func download(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	downreq := DownloadRangeRequest{}
 	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &downreq)
 	if err != nil {
 		// Serve() copes with converting this to stderr rather than JSON response
 		return lfs.NewJsonErrorResponse(req.Id, err.Error())
 	}
-	logf("Download %d: %v requested\n", req.Id, downreq.Oid)
-	filename, err := mediaPath(downreq.Oid, config, path)
+	if downreq.Chunked && !sess.capabilityEnabled(capabilityChunked) {
+		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Chunked downloads need the '%v' capability, which was not enabled for this session", capabilityChunked))
+	}
+	if downreq.Encoding != "" {
+		if !sess.capabilityEnabled(capabilityCompression) {
+			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Compressed downloads need the '%v' capability, which was not enabled for this session", capabilityCompression))
+		}
+		if !downreq.Chunked {
+			return lfs.NewJsonErrorResponse(req.Id, "Compressed downloads must be chunked")
+		}
+		if err := checkEncoding(downreq.Encoding); err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+	}
+	if !downreq.Chunked {
+		// Don't return a response, only response is byte stream except in error cases
+		return sendDownload(req, &downreq, out, sess.Store, path)
+	}
+
+	var encoding string
+	if downreq.Encoding != "" {
+		// Client needs to know how the chunks are encoded before they arrive
+		encoding = chooseEncoding(downreq.Encoding, sess.Store, path, &downreq)
+		logf("Download %d: sending %v with encoding '%v'\n", req.Id, downreq.Oid, encoding)
+		resp, err := lfs.NewJsonResponse(req.Id, DownloadStartResponse{Encoding: encoding})
+		if err == nil {
+			err = sendResponse(resp, out)
+		}
+		if err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, streamFailure(err.Error()))
+		}
+	}
+
+	// Chunked: whatever happens, terminate the chunks and follow with a trailer
+	cw := &chunkWriter{w: out}
+	var content io.Writer = cw
+	var gz *gzip.Writer
+	var buffered *bufio.Writer
+	if encoding == encodingGzip {
+		// Buffer so compressed output goes in full size chunks
+		buffered = bufio.NewWriterSize(cw, downloadChunkSize)
+		gz = gzip.NewWriter(buffered)
+		content = gz
+	}
+	hasher := sha256.New()
+	counter := &countingWriter{}
+	resp := sendDownload(req, &downreq, io.MultiWriter(content, hasher, counter), sess.Store, path)
+	if gz != nil {
+		gz.Close()
+		buffered.Flush()
+	}
+	if resp == nil {
+		resp, err = lfs.NewJsonResponse(req.Id, DownloadTrailer{Size: counter.n, Sha256: hex.EncodeToString(hasher.Sum(nil))})
+		if err != nil {
+			resp = lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+	}
+	if cw.err != nil {
+		// Connection has gone, no use trying to send anything else
+		return lfs.NewJsonErrorResponse(req.Id, streamFailure(cw.err.Error()))
+	}
+	err = cw.finish()
+	if err == nil {
+		err = sendResponse(resp, out)
+	}
 	if err != nil {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Problem determining the media path: %v", err))
+		return lfs.NewJsonErrorResponse(req.Id, streamFailure(err.Error()))
+	}
+	return nil
+}
+
+// Send the content for a download request to out, returning an error response if
+// there's a problem or nil if all was sent
+func sendDownload(req *lfs.JsonRequest, downreq *DownloadRangeRequest, out io.Writer, store Store, path string) *lfs.JsonResponse {
+	logf("Download %d: %v requested\n", req.Id, downreq.Oid)
+	if resp := invalidOidResponse(req.Id, downreq.Oid); resp != nil {
+		return resp
 	}
 	// check size
-	s, err := os.Stat(filename)
+	size, err := store.Size(path, downreq.Oid)
 	if err != nil {
 		// file doesn't exist, this should not have been called
 		return lfs.NewJsonErrorResponse(req.Id, "File doesn't exist")
 	}
-	if s.Size() != downreq.Size {
+	if size != downreq.Size {
 		// This won't work!
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("File sizes disagree (client: %d server: %d)", downreq.Size, s.Size()))
+		return sizeConflictResponse(req.Id, downreq.Oid, size, downreq.Size)
+	}
+	length := downreq.Length
+	if length == 0 {
+		length = size - downreq.Offset
+	}
+	if downreq.Offset < 0 || downreq.Offset > size || length < 0 || length > size-downreq.Offset {
+		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Invalid range offset %d length %d for file of size %d", downreq.Offset, downreq.Length, size))
 	}
 
-	f, err := os.OpenFile(filename, os.O_RDONLY, 0644)
+	f, err := store.Open(path, downreq.Oid)
 	if err != nil {
 		return lfs.NewJsonErrorResponse(req.Id, err.Error())
 	}
 	defer f.Close()
-
-	logf("Download %d: sending content for %v\n", req.Id, downreq.Oid)
-	n, err := io.Copy(out, f)
-	if err != nil {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error copying data to output: %v", err.Error()))
-	}
-	if n != s.Size() {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Amount of data copied disagrees (expected: %d actual: %d)", s.Size(), n))
+	if downreq.Offset > 0 {
+		_, err = f.Seek(downreq.Offset, os.SEEK_SET)
+		if err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unable to seek to %d: %v", downreq.Offset, err.Error()))
+		}
+		logf("Download %d: sending %d bytes of content for %v from %d\n", req.Id, length, downreq.Oid, downreq.Offset)
+	} else {
+		logf("Download %d: sending content for %v\n", req.Id, downreq.Oid)
 	}
+
+	n, err := io.CopyN(out, f, length)
 	if err != nil {
 		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error copying data to output: %v", err.Error()))
 	}
-	if n != s.Size() {
-		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Amount of data copied disagrees (expected: %d actual: %d)", s.Size(), n))
+	if n != length {
+		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Amount of data copied disagrees (expected: %d actual: %d)", length, n))
 	}
 	logf("Download %d: successfully sent content for %v\n", req.Id, downreq.Oid)
-
-	// Don't return a response, only response is byte stream above except in error cases
 	return nil
 }
 
-func batch(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *lfs.JsonResponse {
-	batchreq := lfs.BatchRequest{}
+// Chunked downloads are sent as [length: uint32 BE][data] chunks, ending with a
+// zero length chunk
+const downloadChunkSize = 64 * 1024
+
+type chunkWriter struct {
+	w    io.Writer
+	sent int64
+	// First error writing to w, after which nothing more is written
+	err error
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && cw.err == nil {
+		n := len(p)
+		if n > downloadChunkSize {
+			n = downloadChunkSize
+		}
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(n))
+		_, cw.err = cw.w.Write(append(hdr[:], p[:n]...))
+		if cw.err == nil {
+			written += n
+			cw.sent += int64(n)
+			p = p[n:]
+		}
+	}
+	return written, cw.err
+}
+
+func (cw *chunkWriter) finish() error {
+	var hdr [4]byte
+	_, err := cw.w.Write(hdr[:])
+	return err
+}
+
+// Same as lfs.BatchRequest on the wire, plus the operation the client wants
+type BatchRequest struct {
+	// "upload" or "download". Older clients don't send one, in which case stored
+	// objects are offered for download and missing ones for upload.
+	Operation string                   `json:"operation,omitempty"`
+	Objects   []lfs.BatchRequestObject `json:"objects"`
+}
+
+// Same as lfs.BatchResponseObject on the wire, plus an error for objects which
+// can't be transferred. Action is blank if there's nothing to do, i.e. for
+// objects which are already stored in an upload batch, or which have an error.
+type BatchResponseObject struct {
+	Oid    string            `json:"oid"`
+	Action string            `json:"action"`
+	Size   int64             `json:"size"`
+	Error  *BatchObjectError `json:"error,omitempty"`
+}
+type BatchResponse struct {
+	Results []BatchResponseObject `json:"results"`
+}
+
+type BatchObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Codes for BatchObjectError, the same as the git-lfs Batch API uses
+const (
+	batchErrorForbidden    = 403
+	batchErrorNotFound     = 404
+	batchErrorSizeMismatch = 409
+	batchErrorTooLarge     = 413
+	batchErrorInvalid      = 422
+	batchErrorInternal     = 500
+)
+
+func batch(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	batchreq := BatchRequest{}
 	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &batchreq)
 	if err != nil {
 		return lfs.NewJsonErrorResponse(req.Id, err.Error())
 	}
-	logf("Batch %d: %d objects requested\n", req.Id, len(batchreq.Objects))
-	result := lfs.BatchResponse{}
+	if batchreq.Operation != "" && batchreq.Operation != "upload" && batchreq.Operation != "download" {
+		return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unknown operation '%v'", batchreq.Operation))
+	}
+	logf("Batch %d: %d objects requested for %v\n", req.Id, len(batchreq.Objects), batchreq.Operation)
+	result := BatchResponse{Results: make([]BatchResponseObject, 0, len(batchreq.Objects))}
+	var uploadsize int64
 	for _, o := range batchreq.Objects {
-		filename, err := mediaPath(o.Oid, config, path)
-		if err != nil {
-			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Problem determining the media path: %v", err))
+		resultObj := batchObject(o, batchreq.Operation, path, sess)
+		if resultObj.Action == "upload" {
+			uploadsize += resultObj.Size
 		}
-		resultObj := lfs.BatchResponseObject{Oid: o.Oid}
-		s, err := os.Stat(filename)
-		if err == nil {
-			// file exists
-			resultObj.Action = "download"
-			resultObj.Size = s.Size()
+		if resultObj.Error != nil {
+			logf("Batch %d: %v error %d: %v\n", req.Id, o.Oid, resultObj.Error.Code, resultObj.Error.Message)
 		} else {
-			resultObj.Action = "upload"
-			resultObj.Size = o.Size
+			logf("Batch %d: %v response is %v (%d)\n", req.Id, o.Oid, resultObj.Action, resultObj.Size)
 		}
-		logf("Batch %d: %v response is %v (%d)\n", req.Id, o.Oid, resultObj.Action, resultObj.Size)
 		result.Results = append(result.Results, resultObj)
 	}
 
+	if uploadsize > 0 {
+		usages := quotaUsages(config, sess.Store, sess.User, path)
+		if checkUsage(usages, uploadsize) != nil {
+			// Not everything fits, so offer uploads in order until the quota is reached
+			uploadsize = 0
+			for i := range result.Results {
+				r := &result.Results[i]
+				if r.Action != "upload" {
+					continue
+				}
+				if err := checkUsage(usages, uploadsize+r.Size); err != nil {
+					r.Action = ""
+					r.Error = &BatchObjectError{Code: batchErrorTooLarge, Message: err.Error()}
+					continue
+				}
+				uploadsize += r.Size
+			}
+		}
+	}
 	resp, err := lfs.NewJsonResponse(req.Id, result)
 	if err != nil {
 		return lfs.NewJsonErrorResponse(req.Id, err.Error())
@@ -250,11 +552,90 @@ func batch(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, pa
 
 }
 
-// Store in the same structure as client, just under BasePath
-func mediaPath(sha string, config *Config, path string) (string, error) {
-	abspath := filepath.Join(config.BasePath, path, sha[0:2], sha[2:4])
-	if err := os.MkdirAll(abspath, 0744); err != nil {
-		return "", fmt.Errorf("Error trying to create local media directory in '%s': %s", abspath, err)
+// Decide what the client should do with one object in a batch, or why it can't
+func batchObject(o lfs.BatchRequestObject, operation string, path string, sess *Session) BatchResponseObject {
+	r := BatchResponseObject{Oid: o.Oid, Size: o.Size}
+	if !validOid(o.Oid) {
+		r.Error = &BatchObjectError{Code: batchErrorInvalid, Message: fmt.Sprintf("Invalid oid %q, must be a SHA-256 hash in lower case hex", o.Oid)}
+		return r
+	}
+	if o.Size < 0 {
+		r.Error = &BatchObjectError{Code: batchErrorInvalid, Message: fmt.Sprintf("Invalid size %d", o.Size)}
+		return r
+	}
+	size, err := sess.Store.Size(path, o.Oid)
+	if err == nil {
+		// Sizes are only compared if the client gave one
+		if o.Size != 0 && o.Size != size {
+			r.Error = &BatchObjectError{Code: batchErrorSizeMismatch, Message: sizeConflictMessage(o.Oid, size, o.Size)}
+			return r
+		}
+		r.Size = size
+		if operation != "upload" {
+			r.Action = "download"
+		}
+		return r
+	}
+	if !os.IsNotExist(err) {
+		r.Error = &BatchObjectError{Code: batchErrorInternal, Message: err.Error()}
+		return r
+	}
+	switch {
+	case operation == "download":
+		r.Error = &BatchObjectError{Code: batchErrorNotFound, Message: fmt.Sprintf("Object %v does not exist", o.Oid)}
+	case sess.Permission < PermissionWrite && operation == "upload":
+		r.Error = &BatchObjectError{Code: batchErrorForbidden, Message: fmt.Sprintf("Permission denied: %v does not have write access to %v", sess.User, path)}
+	case sess.Permission < PermissionWrite:
+		// Older clients ask about everything at once, but this user can only download
+		r.Error = &BatchObjectError{Code: batchErrorNotFound, Message: fmt.Sprintf("Object %v does not exist", o.Oid)}
+	default:
+		r.Action = "upload"
+	}
+	return r
+}
+
+// oids are SHA-256 hashes, always 64 lower case hex characters
+var oidRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func validOid(oid string) bool {
+	return oidRegex.MatchString(oid)
+}
+
+// Error codes for ErrorObject, as per http://www.jsonrpc.org/specification
+const (
+	errorCodeInvalidParams = -32602
+	// Server defined: the object is stored with a different size (see repair.go)
+	errorCodeSizeConflict = -32001
+)
+
+// A structured error response, in the style of a JSON-RPC error object
+// Formats as just the message so it reads the same as a plain string error
+type ErrorObject struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *ErrorObject) String() string {
+	return e.Message
+}
+
+// Returns an error response if any of oids are invalid, or nil if they're all OK
+// Must be called before any oid from a client goes anywhere near the filesystem
+func invalidOidResponse(id int, oids ...string) *lfs.JsonResponse {
+	var invalid []string
+	for _, oid := range oids {
+		if !validOid(oid) {
+			invalid = append(invalid, oid)
+		}
+	}
+	if len(invalid) == 0 {
+		return nil
 	}
-	return filepath.Join(abspath, sha), nil
+	logf("Request %d: invalid oid(s) %v\n", id, invalid)
+	return lfs.NewJsonErrorResponse(id, &ErrorObject{
+		Code:    errorCodeInvalidParams,
+		Message: fmt.Sprintf("Invalid oid %q, must be a SHA-256 hash in lower case hex", invalid[0]),
+		Data:    map[string][]string{"invalidOids": invalid},
+	})
 }
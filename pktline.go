@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// git's pkt-line format, as used by git-lfs-transfer: each packet is a 4 digit
+// hex length which includes itself, followed by the payload. Lengths 0000 and
+// 0001 are special packets with no payload, a flush and a delimiter.
+
+const (
+	pktData = iota
+	pktFlush
+	pktDelim
+)
+
+// Largest payload in a single packet
+const maxPktPayload = 65516
+
+type pktlineReader struct {
+	r *bufio.Reader
+}
+
+func newPktlineReader(r io.Reader) *pktlineReader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &pktlineReader{r: br}
+	}
+	return &pktlineReader{r: bufio.NewReader(r)}
+}
+
+// Read one packet, returning its kind and payload (if it's a data packet)
+func (p *pktlineReader) readPacket() (kind int, payload []byte, err error) {
+	var hdr [4]byte
+	if _, err = io.ReadFull(p.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Invalid pkt-line length %q", string(hdr[:]))
+	}
+	switch {
+	case length == 0:
+		return pktFlush, nil, nil
+	case length == 1:
+		return pktDelim, nil, nil
+	case length < 4 || length-4 > maxPktPayload:
+		return 0, nil, fmt.Errorf("Invalid pkt-line length %d", length)
+	}
+	payload = make([]byte, length-4)
+	if _, err = io.ReadFull(p.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return pktData, payload, nil
+}
+
+// Read text packets up to the next flush or delimiter, which is returned as end
+func (p *pktlineReader) readLines() (lines []string, end int, err error) {
+	for {
+		kind, payload, err := p.readPacket()
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind != pktData {
+			return lines, kind, nil
+		}
+		lines = append(lines, strings.TrimSuffix(string(payload), "\n"))
+	}
+}
+
+// Reads the payloads of data packets as a stream, up to the next flush
+type pktDataReader struct {
+	p    *pktlineReader
+	buf  []byte
+	done bool
+}
+
+func (d *pktDataReader) Read(b []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		kind, payload, err := d.p.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		if kind == pktFlush {
+			d.done = true
+		} else if kind == pktData {
+			d.buf = payload
+		}
+	}
+	n := copy(b, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Read anything which hasn't been read yet, up to the flush
+func (d *pktDataReader) drain() error {
+	var buf [4096]byte
+	for {
+		_, err := d.Read(buf[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type pktlineWriter struct {
+	w *bufio.Writer
+}
+
+func newPktlineWriter(w io.Writer) *pktlineWriter {
+	return &pktlineWriter{w: bufio.NewWriterSize(w, maxPktPayload+4)}
+}
+
+func (p *pktlineWriter) writePacket(payload []byte) error {
+	if _, err := fmt.Fprintf(p.w, "%04x", len(payload)+4); err != nil {
+		return err
+	}
+	_, err := p.w.Write(payload)
+	return err
+}
+
+func (p *pktlineWriter) writeLine(line string) error {
+	return p.writePacket([]byte(line + "\n"))
+}
+
+func (p *pktlineWriter) writeDelim() error {
+	_, err := p.w.WriteString("0001")
+	return err
+}
+
+// Write a flush packet and send everything buffered
+func (p *pktlineWriter) flush() error {
+	if _, err := p.w.WriteString("0000"); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+// Write content as a series of data packets
+func (p *pktlineWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxPktPayload {
+			n = maxPktPayload
+		}
+		if err := p.writePacket(b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
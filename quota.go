@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage quotas are configured with named sections, e.g.
+//
+//   [quota "games"]
+//       paths = games/**
+//       limit = 50G
+//
+//   [quota "contractors"]
+//       groups = contractors
+//       limit = 5G
+//
+// A quota with users or groups limits the total size of new objects each of
+// those users uploads (only to the given paths, if any). Otherwise it limits the
+// size of each repo path matching paths. An upload must fit within every quota
+// which applies to it.
+//
+// Repo usage is found by listing the store, then cached and kept up to date as
+// uploads complete, and only listed again once the cache expires. User usage comes
+// from a ledger of the objects each user uploaded, which is pruned of objects no
+// longer in the store when it expires. Both live in a .quota directory in the base path.
+
+const quotaDirName = ".quota"
+
+type Quota struct {
+	Name   string
+	Users  []string
+	Groups []string
+	Paths  []string
+	Limit  int64
+}
+
+func (q *Quota) isUserQuota() bool {
+	return len(q.Users) > 0 || len(q.Groups) > 0
+}
+
+func (q *Quota) appliesTo(u *User, path string) bool {
+	if q.isUserQuota() {
+		// Usage can't be attributed to anonymous users
+		if u == nil || u.Name == "" || !matchUser(q.Users, q.Groups, u) {
+			return false
+		}
+		return len(q.Paths) == 0 || matchAnyPathGlob(q.Paths, path)
+	}
+	return matchAnyPathGlob(q.Paths, path)
+}
+
+// Build quotas from the [quota "name"] sections of the config settings
+func parseQuotaSettings(settings map[string]string, cfg *Config) {
+	quotas := make(map[string]*Quota)
+	for key, val := range settings {
+		if !strings.HasPrefix(key, "quota.") {
+			continue
+		}
+		dot := strings.LastIndex(key, ".")
+		if dot <= len("quota.") {
+			continue
+		}
+		name := key[len("quota."):dot]
+		q, ok := quotas[name]
+		if !ok {
+			q = &Quota{Name: name}
+			quotas[name] = q
+		}
+		switch key[dot+1:] {
+		case "users":
+			q.Users = splitList(val)
+		case "groups":
+			q.Groups = splitList(val)
+		case "paths":
+			q.Paths = splitList(val)
+		case "limit":
+			var err error
+			q.Limit, err = parseByteSize(val)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid configuration: quota.%v.limit=%v\n", name, val)
+			}
+		}
+	}
+	names := make([]string, 0, len(quotas))
+	for name := range quotas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		q := quotas[name]
+		if q.Limit <= 0 || (!q.isUserQuota() && len(q.Paths) == 0) {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: quota %v needs a limit and paths, users or groups\n", name)
+			continue
+		}
+		cfg.Quotas = append(cfg.Quotas, q)
+	}
+}
+
+// Parse a size in bytes with an optional K, M, G or T (binary) suffix
+func parseByteSize(val string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(val))
+	s = strings.TrimSuffix(s, "B")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size '%v'", val)
+	}
+	return n * mult, nil
+}
+
+func formatByteSize(n int64) string {
+	units := []string{"KB", "MB", "GB", "TB"}
+	if n < 1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	f := float64(n)
+	unit := ""
+	for _, u := range units {
+		if f < 1024 {
+			break
+		}
+		f /= 1024
+		unit = u
+	}
+	return fmt.Sprintf("%.1f %v", f, unit)
+}
+
+// Check that storing size more bytes in path for u fits within all the quotas
+// which apply. Returns an error to show to the user if it doesn't.
+func checkQuota(config *Config, store Store, u *User, path string, size int64) error {
+	return checkUsage(quotaUsages(config, store, u, path), size)
+}
+
+// How much of a quota which applies to an upload is already used
+type quotaUsage struct {
+	quota *Quota
+	used  int64
+	whose string
+}
+
+// Current usage of each quota which applies to u storing objects in path
+func quotaUsages(config *Config, store Store, u *User, path string) []quotaUsage {
+	var usages []quotaUsage
+	for _, q := range config.Quotas {
+		if !q.appliesTo(u, path) {
+			continue
+		}
+		var used int64
+		var err error
+		var whose string
+		if q.isUserQuota() {
+			used, err = userUsage(config, store, u.Name, q.Paths)
+			whose = u.Name
+		} else {
+			used, err = repoUsage(config, store, path)
+			whose = path
+		}
+		if err != nil {
+			// Don't stop everyone working because usage can't be worked out
+			logf("Unable to check quota %v for %v: %v\n", q.Name, whose, err.Error())
+			continue
+		}
+		usages = append(usages, quotaUsage{quota: q, used: used, whose: whose})
+	}
+	return usages
+}
+
+// Check that size more bytes fits within all of usages
+func checkUsage(usages []quotaUsage, size int64) error {
+	for _, u := range usages {
+		q := u.quota
+		if u.used+size > q.Limit {
+			logf("Quota %v exceeded for %v: %d used, %d more requested, limit %d\n", q.Name, u.whose, u.used, size, q.Limit)
+			return fmt.Errorf("Storing %v would exceed the '%v' quota of %v for %v, which already uses %v",
+				formatByteSize(size), q.Name, formatByteSize(q.Limit), u.whose, formatByteSize(u.used))
+		}
+	}
+	return nil
+}
+
+// Account for a newly stored object uploaded by u
+func recordUpload(config *Config, u *User, path, oid string, size int64) {
+	if len(config.Quotas) == 0 {
+		return
+	}
+	adjustRepoUsage(config, path, size)
+	if u == nil || u.Name == "" {
+		return
+	}
+	ledger := userLedgerPath(config, u.Name)
+	if err := ensureDirExists(filepath.Dir(ledger), config); err != nil {
+		logf("Unable to record upload by %v: %v\n", u.Name, err.Error())
+		return
+	}
+	f, err := os.OpenFile(ledger, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		logf("Unable to record upload by %v: %v\n", u.Name, err.Error())
+		return
+	}
+	// A single short write so concurrent appends don't interleave
+	fmt.Fprintf(f, "%v %d %v\n", oid, size, toSlash(path))
+	f.Close()
+}
+
+// Account for a repaired object changing size from stored to size. Growth counts
+// as an upload by u, since that's what the quota was checked against.
+func recordRepair(config *Config, u *User, path, oid string, stored, size int64) {
+	if size > stored {
+		recordUpload(config, u, path, oid, size-stored)
+	} else if len(config.Quotas) > 0 {
+		adjustRepoUsage(config, path, size-stored)
+	}
+}
+
+// Update the cached usage of a repo path, if there is one
+func adjustRepoUsage(config *Config, path string, change int64) {
+	cache := repoUsagePath(config, path)
+	if used, computed, ok := readUsageCache(cache); ok {
+		// Concurrent updates may be lost, but that's corrected when the cache expires
+		writeUsageCache(cache, used+change, computed, config)
+	}
+}
+
+func repoUsagePath(config *Config, path string) string {
+	return filepath.Join(config.BasePath, quotaDirName, "paths", path, ".usage")
+}
+
+// User names come from the config or --user, so are escaped so that any path
+// separators in them can't take the ledger outside the users directory
+func userLedgerPath(config *Config, name string) string {
+	return filepath.Join(config.BasePath, quotaDirName, "users", url.PathEscape(name)+".ledger")
+}
+
+// Total size of the objects stored for a repo path, not including nested repo paths
+func repoUsage(config *Config, store Store, path string) (int64, error) {
+	cache := repoUsagePath(config, path)
+	if used, computed, ok := readUsageCache(cache); ok && time.Since(computed) < config.QuotaCacheExpiry {
+		return used, nil
+	}
+	var used int64
+	err := store.List(path, func(obj ObjectInfo) error {
+		if toSlash(obj.Path) == toSlash(path) {
+			used += obj.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	writeUsageCache(cache, used, time.Now(), config)
+	return used, nil
+}
+
+// Cache files hold "<bytes> <unix time computed>"
+func readUsageCache(filename string) (used int64, computed time.Time, ok bool) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	var stamp int64
+	if n, _ := fmt.Sscanf(string(content), "%d %d", &used, &stamp); n != 2 {
+		return 0, time.Time{}, false
+	}
+	return used, time.Unix(stamp, 0), true
+}
+
+func writeUsageCache(filename string, used int64, computed time.Time, config *Config) {
+	if err := ensureDirExists(filepath.Dir(filename), config); err != nil {
+		logf("Unable to cache usage: %v\n", err.Error())
+		return
+	}
+	tempf, err := ioutil.TempFile(filepath.Dir(filename), "tempusage")
+	if err != nil {
+		logf("Unable to cache usage: %v\n", err.Error())
+		return
+	}
+	fmt.Fprintf(tempf, "%d %d\n", used, computed.Unix())
+	tempf.Close()
+	if err := os.Rename(tempf.Name(), filename); err != nil {
+		os.Remove(tempf.Name())
+		logf("Unable to cache usage: %v\n", err.Error())
+	}
+}
+
+type ledgerEntry struct {
+	oid  string
+	size int64
+	path string
+}
+
+// Total size of the objects uploaded by a user which are still stored, only
+// counting those in paths matching globs if there are any
+func userUsage(config *Config, store Store, name string, globs []string) (int64, error) {
+	ledger := userLedgerPath(config, name)
+	entries, err := readLedger(ledger)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	pruned := ledger + ".pruned"
+	if s, err := os.Stat(pruned); err != nil || time.Since(s.ModTime()) > config.QuotaCacheExpiry {
+		entries = pruneLedger(config, store, ledger, entries)
+		ioutil.WriteFile(pruned, nil, 0644)
+	}
+	var used int64
+	for _, e := range entries {
+		if len(globs) == 0 || matchAnyPathGlob(globs, e.path) {
+			used += e.size
+		}
+	}
+	return used, nil
+}
+
+func readLedger(filename string) ([]ledgerEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []ledgerEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, ledgerEntry{oid: fields[0], size: size, path: fields[2]})
+	}
+	return entries, scanner.Err()
+}
+
+// Drop ledger entries for objects which have since been removed from the store
+// (or recorded twice) and rewrite the ledger if anything changed. A repaired
+// object can have a second entry for its growth, which has a different size.
+func pruneLedger(config *Config, store Store, ledger string, entries []ledgerEntry) []ledgerEntry {
+	var kept []ledgerEntry
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		key := fmt.Sprintf("%v %v %d", e.path, e.oid, e.size)
+		if seen[key] || !objectExists(store, e.path, e.oid) {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, e)
+	}
+	if len(kept) == len(entries) {
+		return entries
+	}
+	tempf, err := ioutil.TempFile(filepath.Dir(ledger), "templedger")
+	if err != nil {
+		return kept
+	}
+	w := bufio.NewWriter(tempf)
+	for _, e := range kept {
+		fmt.Fprintf(w, "%v %d %v\n", e.oid, e.size, e.path)
+	}
+	w.Flush()
+	tempf.Close()
+	// Entries appended since it was read would be lost by the rename, so only
+	// replace the ledger if it hasn't changed
+	if current, err := readLedger(ledger); err == nil && len(current) == len(entries) {
+		if err := os.Rename(tempf.Name(), ledger); err == nil {
+			logf("Pruned %d removed objects from %v\n", len(entries)-len(kept), ledger)
+			return kept
+		}
+	}
+	os.Remove(tempf.Name())
+	return kept
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Quotas", func() {
+
+	var config *Config
+	var store Store
+	var alice *User
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		store, _ = NewStore(config)
+		alice = &User{Name: "alice", Groups: []string{"art"}}
+	})
+	AfterEach(func() {
+		os.RemoveAll(config.BasePath)
+	})
+
+	// Upload content as user over a real session, returning any error
+	upload := func(user *User, path string, content []byte) *lfs.WrappedError {
+		cli, srv := net.Pipe()
+		go Serve(srv, srv, GinkgoWriter, config, path, user)
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+		defer ctx.Close()
+		obj, wrerr := ctx.UploadCheck(oidFor(content), int64(len(content)))
+		if wrerr != nil {
+			return wrerr
+		}
+		return ctx.UploadObject(obj, bytes.NewReader(content))
+	}
+
+	It("Parses quota sections", func() {
+		settings, err := ReadConfigStream(strings.NewReader(`
+[quota "games"]
+    paths = games/**
+    limit = 50G
+[quota "art"]
+    groups = art
+    limit = 512k
+[quota "broken"]
+    paths = other/*
+`), "")
+		Expect(err).To(BeNil())
+		parseQuotaSettings(settings, config)
+		Expect(config.Quotas).To(HaveLen(2), "Quota without a limit should be ignored")
+		Expect(config.Quotas[0].Name).To(Equal("art"))
+		Expect(config.Quotas[0].Limit).To(BeEquivalentTo(512 * 1024))
+		Expect(config.Quotas[1].Limit).To(BeEquivalentTo(50 * 1024 * 1024 * 1024))
+		Expect(config.Quotas[0].appliesTo(alice, "anything")).To(BeTrue())
+		Expect(config.Quotas[0].appliesTo(&User{Name: "bob"}, "anything")).To(BeFalse())
+		Expect(config.Quotas[1].appliesTo(nil, "games/tetris")).To(BeTrue())
+		Expect(config.Quotas[1].appliesTo(nil, "music/tetris")).To(BeFalse())
+	})
+
+	It("Limits the size of a repo path", func() {
+		config.Quotas = []*Quota{{Name: "games", Paths: []string{"games/*"}, Limit: 100}}
+		Expect(upload(alice, "games/tetris", bytes.Repeat([]byte("a"), 60))).To(BeNil())
+		Expect(upload(alice, "music/album", bytes.Repeat([]byte("b"), 60))).To(BeNil(), "Other paths shouldn't be limited")
+		Expect(upload(&User{Name: "bob"}, "games/pong", bytes.Repeat([]byte("c"), 60))).To(BeNil(), "Each matching path has its own limit")
+
+		wrerr := upload(&User{Name: "bob"}, "games/tetris", bytes.Repeat([]byte("d"), 60))
+		Expect(wrerr).ToNot(BeNil(), "Upload over the quota should be rejected")
+		Expect(wrerr.Error()).To(ContainSubstring("would exceed the 'games' quota of 100 bytes for games/tetris, which already uses 60 bytes"))
+		Expect(objectExists(store, "games/tetris", oidFor(bytes.Repeat([]byte("d"), 60)))).To(BeFalse())
+
+		Expect(upload(alice, "games/tetris", bytes.Repeat([]byte("e"), 40))).To(BeNil(), "Upload which just fits should be allowed")
+		used, _, ok := readUsageCache(repoUsagePath(config, "games/tetris"))
+		Expect(ok).To(BeTrue(), "Usage should be cached")
+		Expect(used).To(BeEquivalentTo(100), "Cached usage should include new uploads")
+		Expect(upload(alice, "games/tetris", []byte("f"))).ToNot(BeNil())
+	})
+
+	It("Refreshes cached repo usage once it expires", func() {
+		config.Quotas = []*Quota{{Name: "games", Paths: []string{"games/*"}, Limit: 100}}
+		content := bytes.Repeat([]byte("a"), 80)
+		Expect(upload(alice, "games/tetris", content)).To(BeNil())
+		used, err := repoUsage(config, store, "games/tetris")
+		Expect(err).To(BeNil())
+		Expect(used).To(BeEquivalentTo(80))
+
+		store.Delete("games/tetris", oidFor(content))
+		used, _ = repoUsage(config, store, "games/tetris")
+		Expect(used).To(BeEquivalentTo(80), "Should use the cache until it expires")
+		config.QuotaCacheExpiry = 0
+		used, _ = repoUsage(config, store, "games/tetris")
+		Expect(used).To(BeZero(), "Should list the store again once the cache expires")
+	})
+
+	It("Limits what each user uploads", func() {
+		config.Quotas = []*Quota{{Name: "art", Groups: []string{"art"}, Limit: 100}}
+		first := bytes.Repeat([]byte("a"), 60)
+		Expect(upload(alice, "games/tetris", first)).To(BeNil())
+		Expect(upload(&User{Name: "bob"}, "games/tetris", bytes.Repeat([]byte("b"), 60))).To(BeNil(), "Users not in the quota aren't limited")
+
+		wrerr := upload(alice, "music/album", bytes.Repeat([]byte("c"), 60))
+		Expect(wrerr).ToNot(BeNil(), "User's uploads to all paths should count")
+		Expect(wrerr.Error()).To(ContainSubstring("'art' quota of 100 bytes for alice"))
+
+		// Removed objects stop counting once the ledger is pruned
+		store.Delete("games/tetris", oidFor(first))
+		config.QuotaCacheExpiry = 0
+		Expect(upload(alice, "music/album", bytes.Repeat([]byte("c"), 60))).To(BeNil())
+		entries, _ := readLedger(userLedgerPath(config, "alice"))
+		Expect(entries).To(HaveLen(1), "Ledger should only hold objects still stored")
+	})
+
+	It("Keeps user ledgers inside the quota directory", func() {
+		config.Quotas = []*Quota{{Name: "art", Groups: []string{"art"}, Limit: 100}}
+		mallory := &User{Name: "../../escape", Groups: []string{"art"}}
+		content := []byte("from a user with a strange name")
+		Expect(upload(mallory, "games/tetris", content)).To(BeNil())
+		ledger := userLedgerPath(config, mallory.Name)
+		Expect(filepath.Dir(ledger)).To(Equal(filepath.Join(config.BasePath, quotaDirName, "users")))
+		entries, _ := readLedger(ledger)
+		Expect(entries).To(HaveLen(1), "Upload should be recorded in the escaped ledger")
+		_, err := os.Stat(filepath.Join(config.BasePath, "escape.ledger"))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Ledger should not be written outside the users directory")
+	})
+
+	It("Rejects batches which would exceed a quota", func() {
+		config.Quotas = []*Quota{{Name: "games", Paths: []string{"games/*"}, Limit: 100}}
+		cli, srv := net.Pipe()
+		go Serve(srv, srv, GinkgoWriter, config, "games/tetris", alice)
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+		defer ctx.Close()
+		objs, wrerr := ctx.Batch([]*lfs.ObjectResource{
+			{Oid: oidFor([]byte("one")), Size: 60},
+			{Oid: oidFor([]byte("two")), Size: 60},
+		})
+		Expect(wrerr).To(BeNil(), "Objects over quota shouldn't fail the whole batch")
+		Expect(objs[0].CanUpload()).To(BeTrue(), "Objects which fit should still be uploaded")
+		Expect(objs[1].CanUpload()).To(BeFalse(), "Objects over quota shouldn't be uploaded")
+
+		rdr := bufio.NewReader(cli)
+		sendRawRequest(cli, "Batch", &BatchRequest{Operation: "upload", Objects: []lfs.BatchRequestObject{
+			{Oid: oidFor([]byte("one")), Size: 60},
+			{Oid: oidFor([]byte("two")), Size: 60},
+		}})
+		result := BatchResponse{}
+		readRawResponse(rdr, &result)
+		Expect(result.Results[1].Error.Code).To(Equal(batchErrorTooLarge))
+		Expect(result.Results[1].Error.Message).To(ContainSubstring("'games' quota"))
+	})
+
+	It("Parses and formats sizes", func() {
+		for s, n := range map[string]int64{"100": 100, "2k": 2048, "10 MB": 10 << 20, "1G": 1 << 30} {
+			v, err := parseByteSize(s)
+			Expect(err).To(BeNil())
+			Expect(v).To(Equal(n), s)
+		}
+		_, err := parseByteSize("lots")
+		Expect(err).ToNot(BeNil())
+		Expect(formatByteSize(100)).To(Equal("100 bytes"))
+		Expect(formatByteSize(3 << 29)).To(Equal("1.5 GB"))
+	})
+})
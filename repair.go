@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+)
+
+// An oid determines the size of its content, so if a client asks about an object
+// with a different size from the one stored, one of them is wrong. Rather than
+// treating the object as present, requests report a size conflict. If it's the
+// stored object which is damaged (e.g. truncated), an Upload with "repair" set
+// replaces it; the new content must still match the oid before it's stored, so
+// a client can't replace good content with bad.
+
+func sizeConflictMessage(oid string, stored, requested int64) string {
+	return fmt.Sprintf("Size conflict: %v is stored with %d bytes, not %d", oid, stored, requested)
+}
+
+// Error response for an object which is stored with a different size than requested
+func sizeConflictResponse(id int, oid string, stored, requested int64) *lfs.JsonResponse {
+	logf("Request %d: size conflict for %v, stored %d requested %d\n", id, oid, stored, requested)
+	return lfs.NewJsonErrorResponse(id, &ErrorObject{
+		Code:    errorCodeSizeConflict,
+		Message: sizeConflictMessage(oid, stored, requested),
+		Data:    map[string]int64{"storedSize": stored, "requestedSize": requested},
+	})
+}
+
+// Repairing replaces stored content, so needs admin access to path if any access
+// rules are configured. Returns an error response if it's not allowed.
+func repairDeniedResponse(id int, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	if len(config.AccessRules) == 0 || sess.Permission >= PermissionAdmin {
+		return nil
+	}
+	logf("Request %d: repair refused, %v needs admin permission\n", id, sess.User)
+	return lfs.NewJsonErrorResponse(id, fmt.Sprintf("Permission denied: %v needs admin access to %v to repair objects", sess.User, path))
+}
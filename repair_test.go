@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Size conflicts", func() {
+
+	var config *Config
+	var repopath string
+	var content []byte
+	var oid string
+	var filename string
+	var cli net.Conn
+	var rdr *bufio.Reader
+	var done chan int
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+		content = []byte(strings.Repeat("content which gets truncated ", 100))
+		oid = oidFor(content)
+		filename, _ = mediaPath(oid, config, repopath)
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		// Only half of it made it into the store
+		ioutil.WriteFile(filename, content[:len(content)/2], 0644)
+	})
+	AfterEach(func() {
+		cli.Close()
+		<-done
+		os.RemoveAll(config.BasePath)
+	})
+
+	start := func(user *User) {
+		var srv net.Conn
+		cli, srv = net.Pipe()
+		done = make(chan int, 1)
+		go func() {
+			done <- Serve(srv, srv, GinkgoWriter, config, repopath, user)
+			srv.Close()
+		}()
+		rdr = bufio.NewReader(cli)
+	}
+	expectConflict := func(resp *lfs.JsonResponse) {
+		Expect(resp.Error).ToNot(BeNil(), "Size conflict should be reported")
+		errobj, _ := resp.Error.(map[string]interface{})
+		Expect(errobj).To(HaveKeyWithValue("code", BeEquivalentTo(errorCodeSizeConflict)))
+		Expect(errobj).To(HaveKeyWithValue("message", ContainSubstring("Size conflict")))
+	}
+	// Upload, returning the start response and if sent, the completion response
+	upload := func(data []byte, repair bool) (*lfs.JsonResponse, *lfs.JsonResponse) {
+		sendRawRequest(cli, "Upload", &EncodedUploadRequest{Oid: oid, Size: int64(len(content)), Repair: repair})
+		start := lfs.UploadResponse{}
+		resp := readRawResponse(rdr, &start)
+		if resp.Error != nil || !start.OkToSend {
+			return resp, nil
+		}
+		cli.Write(data)
+		return resp, readRawResponse(rdr, nil)
+	}
+
+	It("Reports a conflict instead of treating the object as present", func() {
+		start(nil)
+		sendRawRequest(cli, "UploadCheck", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+		expectConflict(readRawResponse(rdr, nil))
+		sendRawRequest(cli, "UploadStatus", &UploadStatusRequest{Oid: oid, Size: int64(len(content))})
+		expectConflict(readRawResponse(rdr, nil))
+		resp, _ := upload(content, false)
+		expectConflict(resp)
+
+		sendRawRequest(cli, "Batch", &BatchRequest{Operation: "upload", Objects: []lfs.BatchRequestObject{{Oid: oid, Size: int64(len(content))}}})
+		result := BatchResponse{}
+		readRawResponse(rdr, &result)
+		Expect(result.Results[0].Error.Code).To(Equal(batchErrorSizeMismatch))
+
+		sendRawRequest(cli, "Version", &VersionRequest{Capabilities: []string{"chunked"}})
+		readRawResponse(rdr, nil)
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: oid, Size: int64(len(content)), Chunked: true})
+		Expect(readRawChunks(rdr)).To(BeEmpty(), "Nothing should be sent")
+		expectConflict(readRawResponse(rdr, nil))
+	})
+
+	It("Repairs the stored object with verified content", func() {
+		config.DeltaCachePath = filepath.Join(config.BasePath, ".deltacache")
+		cached := filepath.Join(config.DeltaCachePath, repopath, oidFor([]byte("base"))+"-"+oid)
+		os.MkdirAll(filepath.Dir(cached), 0755)
+		ioutil.WriteFile(cached, []byte("delta made from the truncated object"), 0644)
+		start(nil)
+		_, complete := upload([]byte(strings.Repeat("x", len(content))), true)
+		Expect(complete.Error).To(ContainSubstring("failed verification"))
+		stored, _ := ioutil.ReadFile(filename)
+		Expect(stored).To(Equal(content[:len(content)/2]), "Bad content shouldn't replace the stored object")
+
+		resp, complete := upload(content, true)
+		Expect(resp.Error).To(BeNil(), "Repair should be accepted")
+		Expect(complete.Error).To(BeNil(), "Repair should succeed")
+		stored, _ = ioutil.ReadFile(filename)
+		Expect(stored).To(Equal(content), "Object should be repaired")
+		_, err := os.Stat(cached)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Cached deltas for the damaged object should be removed")
+
+		sendRawRequest(cli, "UploadCheck", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+		check := UploadCheckResponse{}
+		resp = readRawResponse(rdr, &check)
+		Expect(resp.Error).To(BeNil(), "No conflict once repaired")
+		Expect(check.OkToSend).To(BeFalse())
+	})
+
+	It("Counts growth from a repair towards quotas", func() {
+		config.Quotas = []*Quota{{Name: "repo", Paths: []string{"**"}, Limit: 1024 * 1024}}
+		store, _ := NewStore(config)
+		used, err := repoUsage(config, store, repopath)
+		Expect(err).To(BeNil())
+		Expect(used).To(BeEquivalentTo(len(content)/2), "Usage should be cached before the repair")
+
+		start(&User{Name: "alice"})
+		_, complete := upload(content, true)
+		Expect(complete.Error).To(BeNil(), "Repair should succeed")
+		used, _, _ = readUsageCache(repoUsagePath(config, repopath))
+		Expect(used).To(BeEquivalentTo(len(content)), "Repo usage should include the growth")
+		used, err = userUsage(config, store, "alice", nil)
+		Expect(err).To(BeNil())
+		Expect(used).To(BeEquivalentTo(len(content)-len(content)/2), "Growth should count as alice's upload")
+	})
+
+	It("Only lets admins repair when access rules are configured", func() {
+		config.AccessRules = []*AccessRule{
+			{Users: []string{"alice"}, Paths: []string{"**"}, Permission: PermissionWrite},
+			{Users: []string{"carol"}, Paths: []string{"**"}, Permission: PermissionAdmin},
+		}
+		start(&User{Name: "alice"})
+		resp, _ := upload(content, true)
+		Expect(resp.Error).To(ContainSubstring("needs admin access"))
+		cli.Close()
+		<-done
+
+		start(&User{Name: "carol"})
+		_, complete := upload(content, true)
+		Expect(complete.Error).To(BeNil(), "Admins can repair objects")
+	})
+})
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Uploads are received into a per-oid partial file in the staging area so that
+// if the connection drops, the client can find out how much the server already
+// has with UploadStatus and send only the rest with UploadResume
+
+type UploadStatusRequest struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+type UploadStatusResponse struct {
+	// Whether the server still needs the content
+	OkToSend bool `json:"okToSend"`
+	// Number of bytes the server already holds from earlier attempts
+	Received int64 `json:"received"`
+}
+type UploadResumeRequest struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+	// Number of bytes already held by the server which the client is not sending
+	Offset int64 `json:"offset"`
+}
+
+func partialPath(oid string, config *Config, path string) string {
+	return filepath.Join(stagingDir(config, path), oid+".partial")
+}
+
+// Remove partial uploads for this repo path which haven't been touched for longer
+// than the configured expiry. Other staged files are left alone, e.g. upload
+// locks are reclaimed by lock.go once they're stale.
+func expirePartials(config *Config, path string) {
+	dir := stagingDir(config, path)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		if strings.HasSuffix(fi.Name(), ".partial") && time.Since(fi.ModTime()) > config.PartialUploadExpiry {
+			logf("Removing expired staged upload %v\n", fi.Name())
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+}
+
+// Return the number of bytes already received for an upload of oid with the
+// given size; partials which have expired or can't be right are removed
+func partialSize(oid string, size int64, config *Config, path string) int64 {
+	partial := partialPath(oid, config, path)
+	s, err := os.Stat(partial)
+	if err != nil {
+		return 0
+	}
+	if time.Since(s.ModTime()) > config.PartialUploadExpiry || s.Size() > size {
+		os.Remove(partial)
+		return 0
+	}
+	return s.Size()
+}
+
+// Receive the rest of an upload of oid into its partial file, which must hold
+// offset bytes already, then verify it and put it in the store.
+// If the data stops arriving part way the partial is kept so it can be resumed,
+// but if the content turns out to be bad it's discarded.
+func receivePartial(in io.Reader, oid string, size, offset int64, store Store, config *Config, path string) error {
+	partial := partialPath(oid, config, path)
+	err := ensureDirExists(filepath.Dir(partial), config)
+	if err != nil {
+		return fmt.Errorf("Unable to create staging directory: %v", err.Error())
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+		// Good time to clear out any old attempts nobody came back for
+		expirePartials(config, path)
+	}
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open partial upload: %v", err.Error())
+	}
+	defer f.Close()
+
+	// Hash everything already held so the final hash covers the whole object
+	hasher := sha256.New()
+	if offset > 0 {
+		n, err := io.CopyN(hasher, f, offset)
+		if err != nil || n != offset {
+			f.Close()
+			os.Remove(partial)
+			return fmt.Errorf("Server only holds %d bytes of %v, cannot resume from %d", n, oid, offset)
+		}
+		// Anything beyond offset is being sent again
+		err = f.Truncate(offset)
+		if err != nil {
+			return fmt.Errorf("Unable to truncate partial upload: %v", err.Error())
+		}
+	}
+
+	n, err := io.CopyN(io.MultiWriter(f, hasher), in, size-offset)
+	if err != nil {
+		return fmt.Errorf("Unable to read data: %v", err.Error())
+	} else if n != size-offset {
+		return fmt.Errorf("Received wrong number of bytes %d (expected %d)", n, size-offset)
+	}
+
+	err = commitUpload(f, hasher, oid, store, path)
+	if err != nil {
+		os.Remove(partial)
+	}
+	return err
+}
+
+func uploadStatus(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	statusreq := UploadStatusRequest{}
+	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &statusreq)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	logf("UploadStatus %d: %v %d requested\n", req.Id, statusreq.Oid, statusreq.Size)
+	if resp := invalidOidResponse(req.Id, statusreq.Oid); resp != nil {
+		return resp
+	}
+	result := UploadStatusResponse{}
+	stored, staterr := sess.Store.Size(path, statusreq.Oid)
+	if staterr == nil && stored != statusreq.Size {
+		return sizeConflictResponse(req.Id, statusreq.Oid, stored, statusreq.Size)
+	}
+	if staterr != nil && os.IsNotExist(staterr) {
+		result.OkToSend = true
+		result.Received = partialSize(statusreq.Oid, statusreq.Size, config, path)
+	}
+	logf("UploadStatus %d: OK to send %v? %v, already received %d\n", req.Id, statusreq.Oid, result.OkToSend, result.Received)
+	resp, err := lfs.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func uploadResume(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse {
+	upreq := UploadResumeRequest{}
+	err := lfs.ExtractStructFromJsonRawMessage(req.Params, &upreq)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	logf("UploadResume %d: requested %v %d from %d\n", req.Id, upreq.Oid, upreq.Size, upreq.Offset)
+	if resp := invalidOidResponse(req.Id, upreq.Oid); resp != nil {
+		return resp
+	}
+	startresult := lfs.UploadResponse{}
+	stored, staterr := sess.Store.Size(path, upreq.Oid)
+	if staterr == nil && stored != upreq.Size {
+		return sizeConflictResponse(req.Id, upreq.Oid, stored, upreq.Size)
+	}
+	if staterr != nil && os.IsNotExist(staterr) {
+		if err := checkQuota(config, sess.Store, sess.User, path, upreq.Size); err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+		lock, exists, err := lockUpload(upreq.Oid, sess.Store, config, path, false)
+		if err != nil {
+			return lfs.NewJsonErrorResponse(req.Id, err.Error())
+		}
+		if lock != nil {
+			defer lock.release()
+		}
+		startresult.OkToSend = !exists
+		if startresult.OkToSend && (upreq.Offset < 0 || upreq.Offset > partialSize(upreq.Oid, upreq.Size, config, path)) {
+			return lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Cannot resume %v from %d, server holds fewer bytes than that", upreq.Oid, upreq.Offset))
+		}
+	}
+	// Send start response immediately
+	resp, err := lfs.NewJsonResponse(req.Id, startresult)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	err = sendResponse(resp, out)
+	if err != nil {
+		return lfs.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	if !startresult.OkToSend {
+		logf("UploadResume %d: content already exists for %v\n", req.Id, upreq.Oid)
+		return nil
+	}
+
+	logf("UploadResume %d: waiting for remaining content %v\n", req.Id, upreq.Oid)
+	receivedresult := lfs.UploadCompleteResponse{ReceivedOk: true}
+	err = receivePartial(in, upreq.Oid, upreq.Size, upreq.Offset, sess.Store, config, path)
+	if err != nil {
+		receivedresult.ReceivedOk = false
+	}
+	resp, _ = lfs.NewJsonResponse(req.Id, receivedresult)
+	if err != nil {
+		logf("UploadResume %d: error in content for %v: %v\n", req.Id, upreq.Oid, err.Error())
+		resp.Error = err.Error()
+	} else {
+		logf("UploadResume %d: content for %v received\n", req.Id, upreq.Oid)
+		recordUpload(config, sess.User, path, upreq.Oid, upreq.Size)
+	}
+	return resp
+}
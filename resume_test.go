@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Resumable uploads", func() {
+
+	var config *Config
+	var repopath string
+	var content []byte
+	var oid string
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+		content = make([]byte, 10000)
+		for i := range content {
+			content[i] = byte(i * 13)
+		}
+		oid = oidFor(content)
+	})
+	AfterEach(func() {
+		os.RemoveAll(config.BasePath)
+	})
+
+	// Start an upload then drop the connection after sending only some of the content
+	interruptedUpload := func(sent int) {
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+		done := make(chan int)
+		go func() {
+			done <- Serve(srv, srv, &outerr, config, repopath, nil)
+		}()
+		rdr := bufio.NewReader(cli)
+		sendRawRequest(cli, "Upload", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+		startresp := lfs.UploadResponse{}
+		readRawResponse(rdr, &startresp)
+		Expect(startresp.OkToSend).To(BeTrue(), "Server should want content")
+		cli.Write(content[:sent])
+		cli.Close()
+		<-done
+	}
+
+	It("Resumes interrupted uploads", func() {
+		interruptedUpload(4000)
+
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+		go Serve(srv, srv, &outerr, config, repopath, nil)
+		defer cli.Close()
+		rdr := bufio.NewReader(cli)
+
+		sendRawRequest(cli, "UploadStatus", &UploadStatusRequest{oid, int64(len(content))})
+		status := UploadStatusResponse{}
+		resp := readRawResponse(rdr, &status)
+		Expect(resp.Error).To(BeNil(), "Should be no error on UploadStatus")
+		Expect(status.OkToSend).To(BeTrue(), "Server should still want content")
+		Expect(status.Received).To(BeEquivalentTo(4000), "Server should report the bytes it already has")
+
+		// Can't skip data the server doesn't have
+		sendRawRequest(cli, "UploadResume", &UploadResumeRequest{oid, int64(len(content)), 5000})
+		resp = readRawResponse(rdr, nil)
+		Expect(resp.Error).ToNot(BeNil(), "Should be an error resuming beyond what the server has")
+
+		sendRawRequest(cli, "UploadResume", &UploadResumeRequest{oid, int64(len(content)), status.Received})
+		startresp := lfs.UploadResponse{}
+		resp = readRawResponse(rdr, &startresp)
+		Expect(resp.Error).To(BeNil(), "Should be no error on UploadResume")
+		Expect(startresp.OkToSend).To(BeTrue(), "Server should want the rest of the content")
+		cli.Write(content[status.Received:])
+		complete := lfs.UploadCompleteResponse{}
+		resp = readRawResponse(rdr, &complete)
+		Expect(resp.Error).To(BeNil(), "Should be no error completing resumed upload")
+		Expect(complete.ReceivedOk).To(BeTrue(), "Resumed upload should be received OK")
+
+		filename, _ := mediaPath(oid, config, repopath)
+		stored, err := ioutil.ReadFile(filename)
+		Expect(err).To(BeNil(), "Object should be in the store")
+		Expect(stored).To(Equal(content), "Object should have the correct content")
+		_, err = os.Stat(partialPath(oid, config, repopath))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Partial upload should have been removed")
+
+		sendRawRequest(cli, "UploadStatus", &UploadStatusRequest{oid, int64(len(content))})
+		resp = readRawResponse(rdr, &status)
+		Expect(status.OkToSend).To(BeFalse(), "Server should not want content it has")
+	})
+
+	It("Expires stale partial uploads", func() {
+		interruptedUpload(4000)
+		partial := partialPath(oid, config, repopath)
+		old := time.Now().Add(-2 * config.PartialUploadExpiry)
+		Expect(os.Chtimes(partial, old, old)).To(Succeed())
+
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+		go Serve(srv, srv, &outerr, config, repopath, nil)
+		defer cli.Close()
+		rdr := bufio.NewReader(cli)
+
+		sendRawRequest(cli, "UploadStatus", &UploadStatusRequest{oid, int64(len(content))})
+		status := UploadStatusResponse{}
+		readRawResponse(rdr, &status)
+		Expect(status.OkToSend).To(BeTrue(), "Server should still want content")
+		Expect(status.Received).To(BeZero(), "Stale partial upload should not count")
+		_, err := os.Stat(partial)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Stale partial upload should have been removed")
+
+		// Starting a new upload clears out other stale partials, but nothing else
+		otheroid := oidFor([]byte("other"))
+		otherpartial := partialPath(otheroid, config, repopath)
+		lockfile := uploadLockPath(otheroid, config, repopath)
+		for _, f := range []string{otherpartial, lockfile} {
+			Expect(ioutil.WriteFile(f, []byte("x"), 0644)).To(Succeed())
+			Expect(os.Chtimes(f, old, old)).To(Succeed())
+		}
+		sendRawRequest(cli, "Upload", &lfs.UploadRequest{Oid: oid, Size: int64(len(content))})
+		readRawResponse(rdr, nil)
+		cli.Write(content)
+		readRawResponse(rdr, nil)
+		_, err = os.Stat(otherpartial)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Stale partial upload should have been removed")
+		_, err = os.Stat(lockfile)
+		Expect(err).To(BeNil(), "Upload locks should be left alone")
+	})
+
+	It("Stages uploads in the configured staging path", func() {
+		config.StagingPath = filepath.Join(os.TempDir(), "git-lfs-serve-test-staging")
+		defer os.RemoveAll(config.StagingPath)
+		interruptedUpload(4000)
+		partial := partialPath(oid, config, repopath)
+		Expect(partial).To(HavePrefix(config.StagingPath), "Partial upload should be in the staging path")
+		s, err := os.Stat(partial)
+		Expect(err).To(BeNil(), "Partial upload should exist")
+		Expect(s.Size()).To(BeEquivalentTo(4000), "Partial upload should hold the bytes sent")
+
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+		go Serve(srv, srv, &outerr, config, repopath, nil)
+		defer cli.Close()
+		rdr := bufio.NewReader(cli)
+		sendRawRequest(cli, "UploadResume", &UploadResumeRequest{oid, int64(len(content)), 4000})
+		readRawResponse(rdr, &lfs.UploadResponse{})
+		cli.Write(content[4000:])
+		complete := lfs.UploadCompleteResponse{}
+		readRawResponse(rdr, &complete)
+		Expect(complete.ReceivedOk).To(BeTrue(), "Resumed upload should be received OK")
+
+		filename, _ := mediaPath(oid, config, repopath)
+		stored, err := ioutil.ReadFile(filename)
+		Expect(err).To(BeNil(), "Object should be in the store")
+		Expect(stored).To(Equal(content), "Object should have the correct content")
+		staged, _ := ioutil.ReadDir(stagingDir(config, repopath))
+		Expect(staged).To(BeEmpty(), "Nothing should be left in the staging path")
+		_, err = os.Stat(filepath.Join(config.BasePath, repopath, stagingDirName))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Default staging directory should not be used")
+	})
+})
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A store which keeps objects in an S3-compatible bucket, e.g. AWS or MinIO.
+// Objects use the same layout as the filesystem store, under an optional prefix:
+//
+//   <prefix>/<repo path>/xx/yy/<oid>
+//
+// Requests use path-style addressing and are signed with AWS signature version 4.
+
+// Size of each part in a multipart upload; objects smaller than this are sent
+// in a single PUT. S3 requires all but the last part to be at least 5MB.
+var s3PartSize = 8 * 1024 * 1024
+
+// Timeouts for connecting to the endpoint and for it to start responding, so a
+// stalled endpoint can't hold up a session (and any upload lock) forever. Bodies
+// aren't timed since they can be whole objects.
+var s3ConnectTimeout = 30 * time.Second
+var s3ResponseTimeout = 2 * time.Minute
+
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+}
+
+func newS3Store(config *Config) (*s3Store, error) {
+	if config.S3Bucket == "" {
+		return nil, fmt.Errorf("s3.bucket must be set to use the S3 store")
+	}
+	endpoint := config.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid s3.endpoint '%v'", endpoint)
+	}
+	s := &s3Store{
+		endpoint:  u,
+		bucket:    config.S3Bucket,
+		region:    config.S3Region,
+		accessKey: config.S3AccessKey,
+		secretKey: config.S3SecretKey,
+		prefix:    strings.Trim(config.S3Prefix, "/"),
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: s3ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   s3ConnectTimeout,
+				ResponseHeaderTimeout: s3ResponseTimeout,
+			},
+		},
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	// Same fallbacks as the AWS tools, so keys needn't be in the config file
+	if s.accessKey == "" {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s.secretKey == "" {
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+func (s *s3Store) key(path, oid string) string {
+	parts := []string{s.prefix, strings.Trim(toSlash(path), "/"), oid[0:2], oid[2:4], oid}
+	var nonblank []string
+	for _, p := range parts {
+		if p != "" {
+			nonblank = append(nonblank, p)
+		}
+	}
+	return strings.Join(nonblank, "/")
+}
+
+func (s *s3Store) Size(path, oid string) (int64, error) {
+	key := s.key(path, oid)
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, &os.PathError{Op: "stat", Path: key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error("HEAD", key, resp)
+	}
+	return resp.ContentLength, nil
+}
+
+func (s *s3Store) Open(path, oid string) (ObjectReader, error) {
+	size, err := s.Size(path, oid)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{store: s, key: s.key(path, oid), size: size}, nil
+}
+
+func (s *s3Store) Begin(path, oid string) (ObjectWriter, error) {
+	return &s3Writer{store: s, key: s.key(path, oid)}, nil
+}
+
+func (s *s3Store) Delete(path, oid string) error {
+	key := s.key(path, oid)
+	resp, err := s.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("DELETE", key, resp)
+	}
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Store) List(path string, fn func(obj ObjectInfo) error) error {
+	listprefix := s.prefix
+	if p := strings.Trim(toSlash(path), "/"); p != "" {
+		if listprefix != "" {
+			listprefix += "/"
+		}
+		listprefix += p
+	}
+	if listprefix != "" {
+		listprefix += "/"
+	}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {listprefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error("GET", "?list-type=2", resp)
+			resp.Body.Close()
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to parse bucket listing: %v", err.Error())
+		}
+		for _, c := range result.Contents {
+			repopath, oid, ok := s.parseKey(c.Key)
+			if !ok {
+				continue
+			}
+			if err := fn(ObjectInfo{Path: repopath, Oid: oid, Size: c.Size, ModTime: c.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Split a key back into repo path & oid; ok is false if it isn't an object key
+func (s *s3Store) parseKey(key string) (path, oid string, ok bool) {
+	if s.prefix != "" {
+		if !strings.HasPrefix(key, s.prefix+"/") {
+			return "", "", false
+		}
+		key = key[len(s.prefix)+1:]
+	}
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 {
+		return "", "", false
+	}
+	oid = parts[len(parts)-1]
+	if !validOid(oid) || parts[len(parts)-2] != oid[2:4] || parts[len(parts)-3] != oid[0:2] {
+		return "", "", false
+	}
+	return strings.Join(parts[:len(parts)-3], "/"), oid, true
+}
+
+// Reads an object with ranged GETs, so seeking and ReadAt don't need the whole object
+type s3Reader struct {
+	store  *s3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) get(offset, length int64) (io.ReadCloser, error) {
+	hdr := http.Header{}
+	if length < 0 {
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	resp, err := r.store.do("GET", r.key, nil, hdr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error("GET", r.key, resp)
+	}
+	return resp.Body, nil
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		var err error
+		r.body, err = r.get(r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	length := int64(len(p))
+	if off+length > r.size {
+		length = r.size - off
+	}
+	body, err := r.get(off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:length])
+	if err == nil && int64(n) < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += r.offset
+	case os.SEEK_END:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, fmt.Errorf("Invalid seek to %d", offset)
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// Buffers one part at a time, switching to a multipart upload once there's more
+// than one part's worth so that large objects are never held in memory
+type s3Writer struct {
+	store    *s3Store
+	key      string
+	buf      bytes.Buffer
+	uploadId string
+	etags    []string
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.buf.Len() > s3PartSize {
+		if err := w.uploadPart(w.buf.Next(s3PartSize)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) uploadPart(part []byte) error {
+	if w.uploadId == "" {
+		resp, err := w.store.do("POST", w.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return s3Error("POST", w.key+"?uploads", resp)
+		}
+		var result struct {
+			UploadId string
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadId == "" {
+			return fmt.Errorf("Unable to start multipart upload of %v", w.key)
+		}
+		w.uploadId = result.UploadId
+	}
+	partnum := len(w.etags) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(partnum)}, "uploadId": {w.uploadId}}
+	resp, err := w.store.do("PUT", w.key, query, nil, part)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("PUT", fmt.Sprintf("%v part %d", w.key, partnum), resp)
+	}
+	w.etags = append(w.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+type s3CompletePart struct {
+	PartNumber int
+	ETag       string
+}
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+func (w *s3Writer) Commit() error {
+	if w.uploadId == "" {
+		// Small enough for a single request
+		resp, err := w.store.do("PUT", w.key, nil, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return s3Error("PUT", w.key, resp)
+		}
+		return nil
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Next(w.buf.Len())); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	complete := s3CompleteMultipartUpload{}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, s3CompletePart{PartNumber: i + 1, ETag: etag})
+	}
+	body, _ := xml.Marshal(complete)
+	resp, err := w.store.do("POST", w.key, url.Values{"uploadId": {w.uploadId}}, nil, body)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	defer resp.Body.Close()
+	// Errors can be reported in the body of a 200 response
+	respbody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || bytes.Contains(respbody, []byte("<Error>")) {
+		w.Abort()
+		return fmt.Errorf("S3 POST %v failed: %v %v", w.key, resp.Status, strings.TrimSpace(string(respbody)))
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.buf.Reset()
+	if w.uploadId == "" {
+		return nil
+	}
+	resp, err := w.store.do("DELETE", w.key, url.Values{"uploadId": {w.uploadId}}, nil, nil)
+	w.uploadId = ""
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func s3Error(method, key string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("S3 %v %v failed: %v %v", method, key, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// Make a signed request for key in the bucket (or the bucket itself if key is blank)
+func (s *s3Store) do(method, key string, query url.Values, hdr http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	signS3Request(req, body, s.accessKey, s.secretKey, s.region, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// Sign a request with AWS signature version 4
+func signS3Request(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	amzdate := now.Format("20060102T150405Z")
+	date := amzdate[:8]
+	payloadhash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadhash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		signed = append(signed, "range")
+	}
+	sort.Strings(signed)
+	var canonheaders bytes.Buffer
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		fmt.Fprintf(&canonheaders, "%v:%v\n", h, strings.TrimSpace(v))
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonheaders.String(),
+		strings.Join(signed, ";"),
+		payloadhash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, region)
+	tosign := strings.Join([]string{"AWS4-HMAC-SHA256", amzdate, scope, sha256Hex([]byte(canonical))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, tosign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, strings.Join(signed, ";"), signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// URI encode as S3 expects; everything except unreserved characters is escaped
+func s3Escape(s string, keepSlash bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (keepSlash && b == '/') {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
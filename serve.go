@@ -8,7 +8,22 @@ import (
 	"io"
 )
 
-type MethodFunc func(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *lfs.JsonResponse
+type MethodFunc func(req *lfs.JsonRequest, in io.Reader, out io.Writer, config *Config, path string, sess *Session) *lfs.JsonResponse
+
+// State for a single client session
+type Session struct {
+	User *User
+	// What User is allowed to do to the repo path
+	Permission Permission
+	// Whether the client has switched to framed mode with Version
+	Framed bool
+	// Where objects are kept
+	Store Store
+	// Capabilities the client enabled with Version, nil if it never asked for any
+	Capabilities map[string]bool
+	// For git-lfs-transfer sessions, whether the client is uploading or downloading
+	Operation string
+}
 
 var methodMap = map[string]MethodFunc{
 	"Upload":        upload,
@@ -16,18 +31,60 @@ var methodMap = map[string]MethodFunc{
 	"DownloadCheck": downloadCheck,
 	"Download":      download,
 	"Batch":         batch,
+	"UploadStatus":  uploadStatus,
+	"UploadResume":  uploadResume,
+	"UploadDelta":   uploadDelta,
+	"DownloadDelta": downloadDelta,
+	"LockCreate":    lockCreate,
+	"LockList":      lockList,
+	"LockDelete":    lockDelete,
+	"LockVerify":    lockVerify,
 	"Version":       version,
 }
 
+// Permission required on the repo path to call each method
+var methodPermissions = map[string]Permission{
+	"Upload":        PermissionWrite,
+	"UploadCheck":   PermissionWrite,
+	"UploadStatus":  PermissionWrite,
+	"UploadResume":  PermissionWrite,
+	"UploadDelta":   PermissionWrite,
+	"DownloadCheck": PermissionRead,
+	"Download":      PermissionRead,
+	"DownloadDelta": PermissionRead,
+	"Batch":         PermissionRead,
+	"LockCreate":    PermissionWrite,
+	"LockList":      PermissionRead,
+	"LockDelete":    PermissionWrite,
+	"LockVerify":    PermissionWrite,
+	"Version":       PermissionNone,
+}
+
 // these methods can't return any error responses
 var bytestreamResponseMethods = map[string]struct{}{
 	"Download": {},
 }
 
-func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path string) int {
+// Error returned by a method which fails once it has started streaming raw bytes
+// to the client, at which point it's too late to send an error response
+type streamFailure string
+
+func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path string, user *User) int {
+
+	store, err := NewStore(config)
+	if err != nil {
+		fmt.Fprintf(outerr, "Unable to open store: %v\n", err.Error())
+		logf("Unable to open store: %v\n", err.Error())
+		return 25
+	}
+	sess := &Session{
+		User:       user,
+		Permission: config.PermissionFor(user, path),
+		Store:      store,
+	}
 
 	// Read input from client on stdin, buffered so we can detect terminators for JSON
-	logf("Client started session\n")
+	logf("Client started session as %v with %v permission\n", sess.User, sess.Permission)
 
 	rdr := bufio.NewReader(in)
 	// we keep reading until stdin is closed
@@ -59,37 +116,12 @@ func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path s
 			return 0
 		}
 
-		logf("Request: %d Method: %v\n", req.Id, req.Method)
-
-		// Get function to handle method
-		f, ok := methodMap[req.Method]
-		var resp *lfs.JsonResponse
-		if !ok {
-			// Since it was valid JSON otherwise, send error as response
-			resp = lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unknown method %v", req.Method))
-		} else {
-			// method found, process
-			resp = f(&req, rdr, out, config, path)
+		if code := handleRequest(&req, rdr, out, outerr, config, path, sess); code != 0 {
+			return code
 		}
-		// There may not have been a JSON response; that might be because method just streams bytes
-		// in which case we just ignore this bit
-		if resp != nil {
-			_, isbytestream := bytestreamResponseMethods[req.Method]
-			if resp.Error != "" && isbytestream {
-				// there was an error but this was a bytestream-only method so can't return JSON
-				// just send it to stderr
-				fmt.Fprintf(outerr, "%v\n", resp.Error)
-				logf("%v\n", resp.Error)
-				return 33
-			} else {
-				// normal method which responds in JSON
-				err := sendResponse(resp, out)
-				if err != nil {
-					fmt.Fprintf(outerr, "%v\n", err.Error())
-					logf("%v\n", err.Error())
-					return 23
-				}
-			}
+		if sess.Framed {
+			logf("Client switched to framed mode\n")
+			return serveFramed(rdr, out, outerr, config, path, sess)
 		}
 
 		// Ready for next request from client
@@ -99,6 +131,56 @@ func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path s
 	return 0
 }
 
+// Dispatch a single request and send its response. Returns non-zero if the
+// session can't continue, as the exit code.
+func handleRequest(req *lfs.JsonRequest, in io.Reader, out io.Writer, outerr io.Writer, config *Config, path string, sess *Session) int {
+	logf("Request: %d Method: %v\n", req.Id, req.Method)
+
+	// Get function to handle method
+	f, ok := methodMap[req.Method]
+	var resp *lfs.JsonResponse
+	if !ok {
+		// Since it was valid JSON otherwise, send error as response
+		resp = lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unknown method %v", req.Method))
+	} else if required := requiredPermission(methodPermissions, req.Method); sess.Permission < required {
+		logf("Request: %d refused, %v needs %v permission\n", req.Id, req.Method, required)
+		resp = lfs.NewJsonErrorResponse(req.Id, fmt.Sprintf("Permission denied: %v does not have %v access to %v", sess.User, required, path))
+	} else if msg := capabilityError(req.Method, sess); msg != "" {
+		resp = lfs.NewJsonErrorResponse(req.Id, msg)
+	} else {
+		// method found, process
+		resp = f(req, in, out, config, path, sess)
+	}
+	// There may not have been a JSON response; that might be because method just streams bytes
+	// in which case we just ignore this bit
+	if resp != nil {
+		_, isbytestream := bytestreamResponseMethods[req.Method]
+		if _, ok := resp.Error.(streamFailure); ok {
+			isbytestream = true
+		}
+		if _, framed := out.(*frameWriter); framed {
+			// Frames keep the error separate from any content already sent
+			isbytestream = false
+		}
+		if resp.Error != "" && isbytestream {
+			// there was an error but this was a bytestream-only method so can't return JSON
+			// just send it to stderr
+			fmt.Fprintf(outerr, "%v\n", resp.Error)
+			logf("%v\n", resp.Error)
+			return 33
+		} else {
+			// normal method which responds in JSON
+			err := sendResponse(resp, out)
+			if err != nil {
+				fmt.Fprintf(outerr, "%v\n", err.Error())
+				logf("%v\n", err.Error())
+				return 23
+			}
+		}
+	}
+	return 0
+}
+
 func sendResponse(resp *lfs.JsonResponse, out io.Writer) error {
 	responseBytes, err := json.Marshal(resp)
 	if err != nil {
@@ -106,6 +188,11 @@ func sendResponse(resp *lfs.JsonResponse, out io.Writer) error {
 	}
 	logf("Response %d: Sending...\n", resp.Id)
 	debugf("Response JSON: %v\n", string(responseBytes))
+	if fw, ok := out.(*frameWriter); ok {
+		err = fw.mux.writeFrame(frameJSON, fw.id, responseBytes)
+		logf("Response %d: Sent.\n", resp.Id)
+		return err
+	}
 	// null terminate response
 	responseBytes = append(responseBytes, byte(0))
 	_, err = out.Write(responseBytes)
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/github/git-lfs/lfs"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
@@ -57,7 +62,7 @@ var _ = Describe("Server tests", func() {
 		var outerr bytes.Buffer
 
 		// 'Serve' is the real server function, usually connected to stdin/stdout but to pipe for test
-		go Serve(srv, srv, &outerr, config, repopath)
+		go Serve(srv, srv, &outerr, config, repopath, nil)
 		defer cli.Close()
 
 		ctx := lfs.NewManualSSHApiContext(cli, cli)
@@ -111,7 +116,7 @@ var _ = Describe("Server tests", func() {
 		Expect(downloadedbytes).To(BeEquivalentTo(testcontent), "Content downloaded from DownloadObject should be correct")
 
 		// Now test safe fail state with DownloadCheck
-		garbageoid := "99999999999999999999999999999999999"
+		garbageoid := "9999999999999999999999999999999999999999999999999999999999999999"
 		obj, wrerr = ctx.DownloadCheck(garbageoid)
 		Expect(obj).To(BeNil(), "DownloadCheck on an invalid OID should report an nil resource")
 		Expect(wrerr).ToNot(BeNil(), "DownloadCheck on an invalid OID should be an error")
@@ -141,4 +146,315 @@ var _ = Describe("Server tests", func() {
 		ctx.Close()
 	})
 
+	It("Rejects uploaded content which doesn't match its oid", func() {
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+
+		go Serve(srv, srv, &outerr, config, repopath, nil)
+		defer cli.Close()
+
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+
+		// Same length as the real content but corrupted part way through
+		badcontent := make([]byte, len(testcontent))
+		copy(badcontent, testcontent)
+		badcontent[100] = 'X'
+
+		obj, wrerr := ctx.UploadCheck(testoid, int64(len(testcontent)))
+		Expect(wrerr).To(BeNil(), "Should be no error on UploadCheck")
+		Expect(obj).ToNot(BeNil(), "Should return valid resource")
+		rdr := bytes.NewReader(badcontent)
+		wrerr = ctx.UploadObject(obj, rdr)
+		Expect(wrerr).ToNot(BeNil(), "Should be an error uploading content which doesn't match the oid")
+		Expect(rdr.Len()).To(BeZero(), "Server should have read all the bytes")
+		uploadDestPath, _ := mediaPath(testoid, config, repopath)
+		_, err := os.Stat(uploadDestPath)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Corrupt content should not have been stored")
+
+		// Session should still be usable and the correct content accepted
+		rdr = bytes.NewReader(testcontent)
+		wrerr = ctx.UploadObject(obj, rdr)
+		Expect(wrerr).To(BeNil(), "Should be no error uploading the correct content")
+		s, err := os.Stat(uploadDestPath)
+		Expect(err).To(BeNil(), "Destination file should exist")
+		Expect(s.Size()).To(BeEquivalentTo(testcontentsz), "Destination file should be the correct length")
+
+		ctx.Close()
+	})
+
+	It("Sends ranges of content for resumed downloads", func() {
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+
+		go Serve(srv, srv, &outerr, config, repopath, nil)
+		defer cli.Close()
+
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+		obj, wrerr := ctx.UploadCheck(testoid, int64(len(testcontent)))
+		Expect(wrerr).To(BeNil(), "Should be no error on UploadCheck")
+		wrerr = ctx.UploadObject(obj, bytes.NewReader(testcontent))
+		Expect(wrerr).To(BeNil(), "Should be no error on UploadObject")
+
+		rdr := bufio.NewReader(cli)
+		// Rest of the content from an offset
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: testoid, Size: testcontentsz, Offset: 200})
+		buf := make([]byte, testcontentsz-200)
+		_, err := io.ReadFull(rdr, buf)
+		Expect(err).To(BeNil(), "Should read the rest of the content")
+		Expect(buf).To(Equal(testcontent[200:]), "Should receive content from the offset")
+
+		// Range in the middle
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: testoid, Size: testcontentsz, Offset: 2, Length: 4})
+		buf = make([]byte, 4)
+		_, err = io.ReadFull(rdr, buf)
+		Expect(err).To(BeNil(), "Should read the range")
+		Expect(buf).To(Equal(testcontent[2:6]), "Should receive the requested range")
+
+		// Whole file still works as before after ranged requests
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: testoid, Size: testcontentsz})
+		buf = make([]byte, testcontentsz)
+		_, err = io.ReadFull(rdr, buf)
+		Expect(err).To(BeNil(), "Should read the whole content")
+		Expect(buf).To(Equal(testcontent), "Should receive the whole content")
+
+		ctx.Close()
+	})
+
+	It("Rejects invalid download ranges", func() {
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+		done := make(chan int)
+
+		go func() {
+			done <- Serve(srv, srv, &outerr, config, repopath, nil)
+		}()
+		defer cli.Close()
+
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+		obj, _ := ctx.UploadCheck(testoid, int64(len(testcontent)))
+		ctx.UploadObject(obj, bytes.NewReader(testcontent))
+
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: testoid, Size: testcontentsz, Offset: 600, Length: 100})
+		Expect(<-done).ToNot(BeZero(), "Server should fail the session on an invalid range")
+		Expect(outerr.String()).To(ContainSubstring("Invalid range"), "Error should be reported on stderr")
+	})
+
+	It("Reports errors in chunked downloads without ending the session", func() {
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+
+		go Serve(srv, srv, &outerr, config, repopath, nil)
+		defer cli.Close()
+
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+		obj, _ := ctx.UploadCheck(testoid, int64(len(testcontent)))
+		ctx.UploadObject(obj, bytes.NewReader(testcontent))
+
+		rdr := bufio.NewReader(cli)
+		readChunks := func() []byte {
+			return readRawChunks(rdr)
+		}
+
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: testoid, Size: testcontentsz, Chunked: true})
+		Expect(readChunks()).To(Equal(testcontent), "Should receive the whole content in chunks")
+		trailer := DownloadTrailer{}
+		resp := readRawResponse(rdr, &trailer)
+		Expect(resp.Error).To(BeNil(), "Trailer should not report an error")
+		Expect(trailer.Size).To(BeEquivalentTo(testcontentsz), "Trailer should report the size sent")
+		Expect(trailer.Sha256).To(Equal(testoid), "Trailer should report the checksum of the content")
+
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: testoid, Size: testcontentsz, Offset: 600, Length: 100, Chunked: true})
+		Expect(readChunks()).To(BeEmpty(), "Should be no content for an invalid range")
+		resp = readRawResponse(rdr, nil)
+		Expect(resp.Error).To(ContainSubstring("Invalid range"), "Trailer should report the error")
+
+		// Offset + length would overflow
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: testoid, Size: testcontentsz, Offset: 2, Length: math.MaxInt64, Chunked: true})
+		Expect(readChunks()).To(BeEmpty(), "Should be no content for an invalid range")
+		resp = readRawResponse(rdr, nil)
+		Expect(resp.Error).To(ContainSubstring("Invalid range"), "Trailer should report the error")
+
+		sendRawRequest(cli, "Download", &DownloadRangeRequest{Oid: testoid, Size: testcontentsz, Offset: 2, Length: 4, Chunked: true})
+		Expect(readChunks()).To(Equal(testcontent[2:6]), "Session should continue after an error")
+		resp = readRawResponse(rdr, &trailer)
+		Expect(resp.Error).To(BeNil(), "Trailer should not report an error")
+		Expect(trailer.Size).To(BeEquivalentTo(4), "Trailer should report the size of the range")
+
+		ctx.Close()
+		Expect(outerr.String()).To(BeEmpty(), "Nothing should be reported on stderr")
+	})
+
+	It("Rejects invalid oids without touching the filesystem", func() {
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+		done := make(chan int)
+
+		go func() {
+			done <- Serve(srv, srv, &outerr, config, repopath, nil)
+		}()
+		defer cli.Close()
+
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+		rdr := bufio.NewReader(cli)
+
+		for _, badoid := range []string{"", "99", "../../../../etc/passwd", strings.ToUpper(testoid), testoid + "00", testoid[:62] + "/x"} {
+			_, wrerr := ctx.UploadCheck(badoid, 10)
+			Expect(wrerr).ToNot(BeNil(), "UploadCheck should fail for invalid oid %q", badoid)
+			_, wrerr = ctx.DownloadCheck(badoid)
+			Expect(wrerr).ToNot(BeNil(), "DownloadCheck should fail for invalid oid %q", badoid)
+
+			sendRawRequest(cli, "Upload", &lfs.UploadRequest{Oid: badoid, Size: 10})
+			resp := readRawResponse(rdr, nil)
+			Expect(resp.Error).ToNot(BeNil(), "Upload should fail for invalid oid %q", badoid)
+			errobj, _ := resp.Error.(map[string]interface{})
+			Expect(errobj).To(HaveKeyWithValue("code", BeEquivalentTo(errorCodeInvalidParams)), "Error should be structured")
+		}
+
+		sendRawRequest(cli, "Batch", &lfs.BatchRequest{Objects: []lfs.BatchRequestObject{{Oid: testoid, Size: 1}, {Oid: "../x", Size: 1}}})
+		batchresult := BatchResponse{}
+		resp := readRawResponse(rdr, &batchresult)
+		Expect(resp.Error).To(BeNil(), "An invalid oid shouldn't fail the whole batch")
+		Expect(batchresult.Results[0].Action).To(Equal("upload"))
+		Expect(batchresult.Results[1].Error.Code).To(Equal(batchErrorInvalid), "Invalid oid should have its own error")
+
+		// Nothing should have been created for any of that
+		_, err := os.Stat(filepath.Join(config.BasePath, repopath))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "No directories should have been created")
+
+		// Download can only report on stderr
+		sendRawRequest(cli, "Download", &lfs.DownloadRequest{Oid: "../../x", Size: 10})
+		Expect(<-done).ToNot(BeZero(), "Download of invalid oid should end the session")
+		Expect(outerr.String()).To(ContainSubstring("Invalid oid"), "Error should be reported on stderr")
+	})
+
+	It("Only creates directories when content is stored", func() {
+		Expect(os.Chmod(config.BasePath, 0750)).To(Succeed())
+		cli, srv := net.Pipe()
+		var outerr bytes.Buffer
+
+		go Serve(srv, srv, &outerr, config, repopath, nil)
+		defer cli.Close()
+
+		ctx := lfs.NewManualSSHApiContext(cli, cli)
+		var inobjs []*lfs.ObjectResource
+		for i := 0; i < 20; i++ {
+			missingoid := oidFor([]byte{byte(i)})
+			_, wrerr := ctx.DownloadCheck(missingoid)
+			Expect(wrerr).ToNot(BeNil(), "DownloadCheck should report missing object")
+			_, wrerr = ctx.UploadCheck(missingoid, 1)
+			Expect(wrerr).To(BeNil(), "UploadCheck should be fine for missing object")
+			inobjs = append(inobjs, &lfs.ObjectResource{Oid: missingoid, Size: 1})
+		}
+		_, wrerr := ctx.Batch(inobjs)
+		Expect(wrerr).To(BeNil(), "Should be no error on Batch")
+		_, err := os.Stat(filepath.Join(config.BasePath, repopath))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "No directories should have been created")
+
+		obj, wrerr := ctx.UploadCheck(testoid, testcontentsz)
+		Expect(wrerr).To(BeNil(), "Should be no error on UploadCheck")
+		wrerr = ctx.UploadObject(obj, bytes.NewReader(testcontent))
+		Expect(wrerr).To(BeNil(), "Should be no error on UploadObject")
+		uploadDestPath, _ := mediaPath(testoid, config, repopath)
+		s, err := os.Stat(filepath.Dir(uploadDestPath))
+		Expect(err).To(BeNil(), "Directory should have been created for upload")
+		Expect(s.Mode().Perm()).To(Equal(os.FileMode(0750)), "Directory should have the same permissions as the base path")
+
+		ctx.Close()
+	})
+
+	It("Answers batches for the operation requested, with errors per object", func() {
+		store, _ := NewStore(config)
+		w, _ := store.Begin(repopath, testoid)
+		w.Write(testcontent)
+		Expect(w.Commit()).To(Succeed())
+		missing := oidFor([]byte("missing"))
+		objects := []lfs.BatchRequestObject{
+			{Oid: testoid, Size: testcontentsz},
+			{Oid: missing, Size: 7},
+			{Oid: "not an oid", Size: 1},
+			{Oid: testoid, Size: testcontentsz - 1},
+		}
+		run := func(user *User, operation string) []BatchResponseObject {
+			cli, srv := net.Pipe()
+			go Serve(srv, srv, GinkgoWriter, config, repopath, user)
+			defer cli.Close()
+			rdr := bufio.NewReader(cli)
+			sendRawRequest(cli, "Batch", &BatchRequest{Operation: operation, Objects: objects})
+			result := BatchResponse{}
+			resp := readRawResponse(rdr, &result)
+			Expect(resp.Error).To(BeNil(), "Object errors shouldn't fail the batch")
+			Expect(result.Results).To(HaveLen(len(objects)))
+			return result.Results
+		}
+
+		results := run(nil, "download")
+		Expect(results[0].Action).To(Equal("download"))
+		Expect(results[1].Action).To(BeEmpty(), "Download batches should never ask for an upload")
+		Expect(results[1].Error.Code).To(Equal(batchErrorNotFound))
+		Expect(results[2].Error.Code).To(Equal(batchErrorInvalid))
+		Expect(results[3].Error.Code).To(Equal(batchErrorSizeMismatch))
+
+		results = run(nil, "upload")
+		Expect(results[0].Action).To(BeEmpty(), "Stored objects needn't be uploaded")
+		Expect(results[0].Error).To(BeNil())
+		Expect(results[1].Action).To(Equal("upload"))
+
+		config.AccessRules = []*AccessRule{{Users: []string{"*"}, Paths: []string{"**"}, Permission: PermissionRead}}
+		results = run(&User{Name: "carol"}, "upload")
+		Expect(results[1].Error.Code).To(Equal(batchErrorForbidden), "Read-only users can't upload")
+		results = run(&User{Name: "carol"}, "")
+		Expect(results[0].Action).To(Equal("download"))
+		Expect(results[1].Error.Code).To(Equal(batchErrorNotFound), "Read-only users aren't asked to upload")
+	})
 })
+
+// Calculate the oid of some content
+func oidFor(content []byte) string {
+	hasher := sha256.New()
+	hasher.Write(content)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Send a request for a method which the client API doesn't know about
+func sendRawRequest(w io.Writer, method string, params interface{}) *lfs.JsonRequest {
+	req, err := lfs.NewJsonRequest(method, params)
+	Expect(err).To(BeNil(), "Should be able to create request")
+	reqbytes, err := json.Marshal(req)
+	Expect(err).To(BeNil(), "Should be able to encode request")
+	_, err = w.Write(append(reqbytes, byte(0)))
+	Expect(err).To(BeNil(), "Should be able to send request")
+	return req
+}
+
+// Read the content of a chunked download, up to the terminating empty chunk
+func readRawChunks(r *bufio.Reader) []byte {
+	var content []byte
+	for {
+		var hdr [4]byte
+		_, err := io.ReadFull(r, hdr[:])
+		Expect(err).To(BeNil(), "Should read chunk header")
+		n := binary.BigEndian.Uint32(hdr[:])
+		if n == 0 {
+			return content
+		}
+		chunk := make([]byte, n)
+		_, err = io.ReadFull(r, chunk)
+		Expect(err).To(BeNil(), "Should read chunk")
+		content = append(content, chunk...)
+	}
+}
+
+// Read a response for a method which the client API doesn't know about
+// If there's no error the result is decoded into result
+func readRawResponse(r *bufio.Reader, result interface{}) *lfs.JsonResponse {
+	jsonbytes, err := r.ReadBytes(byte(0))
+	Expect(err).To(BeNil(), "Should be able to read response")
+	resp := &lfs.JsonResponse{}
+	err = json.Unmarshal(jsonbytes[:len(jsonbytes)-1], resp)
+	Expect(err).To(BeNil(), "Response should be valid JSON")
+	if resp.Error == nil && result != nil {
+		err = lfs.ExtractStructFromJsonRawMessage(resp.Result, result)
+		Expect(err).To(BeNil(), "Response result should be the correct type")
+	}
+	return resp
+}
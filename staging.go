@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Incoming content is staged in a per-repo directory until it's been verified.
+// By default this is inside the repo's own directory in the store so that it's on
+// the same filesystem and can be renamed into place, but it can be configured to
+// be elsewhere, in which case content is copied into place instead.
+
+const stagingDirName = ".staging"
+
+func stagingDir(config *Config, path string) string {
+	if config.StagingPath != "" {
+		return filepath.Join(config.StagingPath, path)
+	}
+	return filepath.Join(config.BasePath, path, stagingDirName)
+}
+
+// Create a temp file in the staging area for a repo
+func stagingTempFile(config *Config, path, prefix string) (*os.File, error) {
+	dir := stagingDir(config, path)
+	if err := ensureDirExists(dir, config); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, prefix)
+}
+
+// Move a fully written & synced file to dest such that dest is either absent or
+// complete, never partially written, even across a crash
+func moveIntoPlace(src, dest string) error {
+	err := os.Rename(src, dest)
+	if err != nil {
+		// Probably staging is on a different filesystem (EXDEV); copy to a temp
+		// file next to dest first so that the final step is still an atomic rename
+		err = copyIntoPlace(src, dest)
+		if err != nil {
+			return err
+		}
+		os.Remove(src)
+	}
+	// Make the rename itself durable
+	syncDir(filepath.Dir(dest))
+	return nil
+}
+
+func copyIntoPlace(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tempf, err := ioutil.TempFile(filepath.Dir(dest), "tempcopy")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempf, in)
+	if err == nil {
+		err = tempf.Sync()
+	}
+	if closeerr := tempf.Close(); err == nil {
+		err = closeerr
+	}
+	if err == nil {
+		err = os.Rename(tempf.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tempf.Name())
+	}
+	return err
+}
+
+// Flush directory entries to disk; not possible on all platforms so errors are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
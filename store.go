@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store is where object content is kept. Objects are identified by the repo path
+// they're stored under and their oid, which callers must already have validated.
+// Staging of incoming content, partial uploads and locks are always local, the
+// store only sees complete, verified objects.
+type Store interface {
+	// Size of an object; the error satisfies os.IsNotExist if it isn't present
+	Size(path, oid string) (int64, error)
+	// Open an object for reading
+	Open(path, oid string) (ObjectReader, error)
+	// Begin writing an object, which isn't visible until the writer is committed
+	Begin(path, oid string) (ObjectWriter, error)
+	// Remove an object
+	Delete(path, oid string) error
+	// Call fn for every object under path, or every object in the store if path
+	// is blank. Stops at the first error from fn and returns it.
+	List(path string, fn func(obj ObjectInfo) error) error
+}
+
+// An object found by Store.List
+type ObjectInfo struct {
+	// Repo path the object is stored under
+	Path    string
+	Oid     string
+	Size    int64
+	ModTime time.Time
+}
+
+type ObjectReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+type ObjectWriter interface {
+	io.Writer
+	// Make the object visible in the store. Either all the content written
+	// becomes visible or none of it does.
+	Commit() error
+	// Discard everything written
+	Abort() error
+}
+
+// Implemented by stores which can take over a complete local file more cheaply
+// than copying it through an ObjectWriter
+type fileImporter interface {
+	Import(path, oid, filename string) error
+}
+
+// Create the store selected by the config
+func NewStore(config *Config) (Store, error) {
+	switch strings.ToLower(config.Store) {
+	case "", "filesystem":
+		return &fsStore{config: config}, nil
+	case "s3":
+		return newS3Store(config)
+	}
+	return nil, fmt.Errorf("Unknown store type '%v'", config.Store)
+}
+
+func objectExists(store Store, path, oid string) bool {
+	_, err := store.Size(path, oid)
+	return err == nil
+}
+
+// Put a complete local file which has been verified as oid into the store.
+// The file is gone afterwards if this succeeds.
+func importObject(store Store, path, oid, filename string) error {
+	if imp, ok := store.(fileImporter); ok {
+		return imp.Import(path, oid, filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := store.Begin(path, oid)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	if err == nil {
+		err = w.Commit()
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	f.Close()
+	os.Remove(filename)
+	return nil
+}
+
+// The default store, which keeps objects under BasePath in the same structure as
+// the client (see mediaPath)
+type fsStore struct {
+	config *Config
+}
+
+func (s *fsStore) Size(path, oid string) (int64, error) {
+	filename, err := mediaPath(oid, s.config, path)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *fsStore) Open(path, oid string) (ObjectReader, error) {
+	filename, err := mediaPath(oid, s.config, path)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filename, os.O_RDONLY, 0644)
+}
+
+func (s *fsStore) Begin(path, oid string) (ObjectWriter, error) {
+	filename, err := mediaPath(oid, s.config, path)
+	if err != nil {
+		return nil, err
+	}
+	tempf, err := stagingTempFile(s.config, path, "tempobject")
+	if err != nil {
+		return nil, err
+	}
+	return &fsObjectWriter{File: tempf, filename: filename, config: s.config}, nil
+}
+
+func (s *fsStore) Import(path, oid, filename string) error {
+	dest, err := mediaPath(oid, s.config, path)
+	if err != nil {
+		return err
+	}
+	err = ensureDirExists(filepath.Dir(dest), s.config)
+	if err != nil {
+		return err
+	}
+	return moveIntoPlace(filename, dest)
+}
+
+func (s *fsStore) Delete(path, oid string) error {
+	filename, err := mediaPath(oid, s.config, path)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+func (s *fsStore) List(path string, fn func(obj ObjectInfo) error) error {
+	root := filepath.Join(s.config.BasePath, path)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if p == root && os.IsNotExist(err) {
+				// Nothing stored yet
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if strings.HasPrefix(fi.Name(), ".") && p != root {
+				// staging, delta cache etc
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Objects are always at <repo path>/xx/yy/oid
+		oid := fi.Name()
+		dir := filepath.Dir(p)
+		if !validOid(oid) || filepath.Base(dir) != oid[2:4] || filepath.Base(filepath.Dir(dir)) != oid[0:2] {
+			return nil
+		}
+		rel, err := filepath.Rel(s.config.BasePath, filepath.Dir(filepath.Dir(dir)))
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		return fn(ObjectInfo{Path: rel, Oid: oid, Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// Store in the same structure as client, just under BasePath
+// This only builds the path, directories are created when content is committed
+func mediaPath(sha string, config *Config, path string) (string, error) {
+	if !validOid(sha) {
+		return "", fmt.Errorf("Invalid oid '%v'", sha)
+	}
+	return filepath.Join(config.BasePath, path, sha[0:2], sha[2:4], sha), nil
+}
+
+// Writes to a temp file in staging then moves it into place on commit
+type fsObjectWriter struct {
+	*os.File
+	filename string
+	config   *Config
+}
+
+func (w *fsObjectWriter) Commit() error {
+	err := w.File.Sync()
+	if closeerr := w.File.Close(); err == nil {
+		err = closeerr
+	}
+	if err == nil {
+		err = ensureDirExists(filepath.Dir(w.filename), w.config)
+	}
+	if err == nil {
+		err = moveIntoPlace(w.File.Name(), w.filename)
+	}
+	if err != nil {
+		os.Remove(w.File.Name())
+	}
+	return err
+}
+
+func (w *fsObjectWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("Filesystem store", func() {
+
+	var config *Config
+	var store Store
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		var err error
+		store, err = NewStore(config)
+		Expect(err).To(BeNil(), "Should be able to create default store")
+	})
+	AfterEach(func() {
+		os.RemoveAll(config.BasePath)
+	})
+
+	put := func(path string, content []byte) string {
+		oid := oidFor(content)
+		w, err := store.Begin(path, oid)
+		Expect(err).To(BeNil(), "Should be able to begin writing")
+		_, err = w.Write(content)
+		Expect(err).To(BeNil(), "Should be able to write")
+		Expect(w.Commit()).To(Succeed(), "Should be able to commit")
+		return oid
+	}
+
+	It("Stores, lists and deletes objects", func() {
+		oid1 := put("team/repo1", []byte("first"))
+		oid2 := put("team/repo2", []byte("second!"))
+
+		size, err := store.Size("team/repo1", oid1)
+		Expect(err).To(BeNil(), "Committed object should exist")
+		Expect(size).To(BeEquivalentTo(5))
+		_, err = store.Size("team/repo1", oid2)
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Objects are per repo path")
+
+		f, err := store.Open("team/repo2", oid2)
+		Expect(err).To(BeNil(), "Should be able to open object")
+		content, _ := ioutil.ReadAll(f)
+		f.Close()
+		Expect(string(content)).To(Equal("second!"))
+
+		var listed []string
+		err = store.List("", func(obj ObjectInfo) error {
+			listed = append(listed, filepath.ToSlash(obj.Path)+":"+obj.Oid)
+			return nil
+		})
+		Expect(err).To(BeNil(), "Should be able to list objects")
+		sort.Strings(listed)
+		Expect(listed).To(Equal([]string{"team/repo1:" + oid1, "team/repo2:" + oid2}), "Should list objects in all repos")
+
+		listed = nil
+		store.List("team/repo2", func(obj ObjectInfo) error {
+			listed = append(listed, obj.Oid)
+			Expect(obj.Size).To(BeEquivalentTo(7))
+			return nil
+		})
+		Expect(listed).To(Equal([]string{oid2}), "Should only list objects in the given repo")
+
+		Expect(store.Delete("team/repo1", oid1)).To(Succeed())
+		Expect(objectExists(store, "team/repo1", oid1)).To(BeFalse(), "Deleted object should be gone")
+	})
+
+	It("Doesn't store aborted objects", func() {
+		oid := oidFor([]byte("aborted"))
+		w, err := store.Begin("repo", oid)
+		Expect(err).To(BeNil())
+		w.Write([]byte("abort"))
+		Expect(w.Abort()).To(Succeed())
+		Expect(objectExists(store, "repo", oid)).To(BeFalse(), "Aborted object should not exist")
+		staged, _ := ioutil.ReadDir(stagingDir(config, "repo"))
+		Expect(staged).To(BeEmpty(), "Nothing should be left in staging")
+	})
+
+	It("Rejects unknown store types", func() {
+		config.Store = "floppy"
+		_, err := NewStore(config)
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// git-lfs-transfer <path> <upload|download>
+//
+// The pkt-line based SSH protocol which current git-lfs clients use in preference
+// to HTTP. The server first advertises its capabilities, then the client sends
+// requests until it quits or disconnects. A request is a command line and
+// key=value arguments, optionally followed by a delimiter and data, ending with a
+// flush. Responses are the same, with a 'status <code>' line in place of the
+// command; errors have the message as their data.
+
+const transferProgram = "git-lfs-transfer"
+
+const (
+	transferUpload   = "upload"
+	transferDownload = "download"
+)
+
+type transferRequest struct {
+	// e.g. "put-object"
+	command string
+	// Rest of the command line, e.g. the oid for put-object
+	arg  string
+	args map[string]string
+	// Data section, nil if the request didn't have one
+	data *pktDataReader
+}
+
+// Respond to a request, returning an error only if the client can't be written to
+type transferFunc func(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error
+
+var transferCommands = map[string]transferFunc{
+	"version":       transferVersion,
+	"batch":         transferBatch,
+	"get-object":    transferGetObject,
+	"put-object":    transferPutObject,
+	"verify-object": transferVerifyObject,
+	"lock":          transferLock,
+	"list-lock":     transferListLock,
+	"unlock":        transferUnlock,
+}
+
+// Permission required on the repo path for each command
+var transferPermissions = map[string]Permission{
+	"version":       PermissionNone,
+	"batch":         PermissionRead,
+	"get-object":    PermissionRead,
+	"verify-object": PermissionRead,
+	"put-object":    PermissionWrite,
+	"lock":          PermissionWrite,
+	"list-lock":     PermissionRead,
+	"unlock":        PermissionWrite,
+}
+
+func ServeTransfer(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path, operation string, user *User) int {
+	store, err := NewStore(config)
+	if err != nil {
+		fmt.Fprintf(outerr, "Unable to open store: %v\n", err.Error())
+		logf("Unable to open store: %v\n", err.Error())
+		return 25
+	}
+	sess := &Session{
+		User:       user,
+		Permission: config.PermissionFor(user, path),
+		Store:      store,
+		Operation:  operation,
+	}
+	if operation == transferUpload && sess.Permission < PermissionWrite {
+		fmt.Fprintf(outerr, "Permission denied: %v does not have write access to %v\n", sess.User, path)
+		logf("Transfer refused, %v needs write permission to upload\n", sess.User)
+		return 20
+	}
+	logf("Client started %v transfer session as %v with %v permission\n", operation, sess.User, sess.Permission)
+
+	pr := newPktlineReader(in)
+	pw := newPktlineWriter(out)
+	err = pw.writeLine("version=1")
+	if err == nil {
+		err = pw.writeLine("locking")
+	}
+	if err == nil {
+		err = pw.flush()
+	}
+	if err != nil {
+		logf("Unable to write to client: %v\n", err.Error())
+		return 23
+	}
+	for {
+		req, err := readTransferRequest(pr)
+		if err != nil {
+			if err == io.EOF {
+				// normal exit
+				return 0
+			}
+			fmt.Fprintf(outerr, "Unable to read from client: %v\n", err.Error())
+			logf("Unable to read from client: %v\n", err.Error())
+			return 21
+		}
+		logf("Transfer request: %v %v\n", req.command, req.arg)
+		if req.command == "quit" {
+			writeTransferStatus(pw, 200)
+			logf("Client exited\n")
+			return 0
+		}
+
+		f, ok := transferCommands[req.command]
+		if !ok {
+			err = req.fail(pw, 400, "Unknown command %v", req.command)
+		} else if required := requiredPermission(transferPermissions, req.command); sess.Permission < required {
+			logf("Transfer request refused, %v needs %v permission\n", req.command, required)
+			err = req.fail(pw, 403, "Permission denied: %v does not have %v access to %v", sess.User, required, path)
+		} else {
+			err = f(req, pw, config, path, sess)
+		}
+		if err == nil && req.data != nil {
+			// Make sure the next request starts in the right place
+			err = req.data.drain()
+		}
+		if err != nil {
+			fmt.Fprintf(outerr, "%v\n", err.Error())
+			logf("%v\n", err.Error())
+			return 23
+		}
+	}
+}
+
+func readTransferRequest(pr *pktlineReader) (*transferRequest, error) {
+	lines, end, err := pr.readLines()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("Empty request")
+	}
+	req := &transferRequest{args: make(map[string]string)}
+	fields := strings.SplitN(lines[0], " ", 2)
+	req.command = fields[0]
+	if len(fields) > 1 {
+		req.arg = fields[1]
+	}
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			req.args[kv[0]] = kv[1]
+		}
+	}
+	if end == pktDelim {
+		req.data = &pktDataReader{p: pr}
+	}
+	return req, nil
+}
+
+// Send an error response, once any data the client is still sending has been read
+func (req *transferRequest) fail(w *pktlineWriter, code int, format string, v ...interface{}) error {
+	return req.failWithArgs(w, code, nil, fmt.Sprintf(format, v...))
+}
+
+// Send an error response which has arguments as well as the message
+func (req *transferRequest) failWithArgs(w *pktlineWriter, code int, args []string, msg string) error {
+	if req.data != nil {
+		if err := req.data.drain(); err != nil {
+			return err
+		}
+	}
+	logf("Transfer %v %v failed with %d: %v\n", req.command, req.arg, code, msg)
+	if err := w.writeLine(fmt.Sprintf("status %d", code)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := w.writeLine(arg); err != nil {
+			return err
+		}
+	}
+	if err := w.writeDelim(); err != nil {
+		return err
+	}
+	if err := w.writeLine(msg); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// Send a successful response, once any data the client is still sending has been read
+func (req *transferRequest) succeed(w *pktlineWriter, args ...string) error {
+	return req.respond(w, 200, args...)
+}
+
+func (req *transferRequest) respond(w *pktlineWriter, code int, args ...string) error {
+	if req.data != nil {
+		if err := req.data.drain(); err != nil {
+			return err
+		}
+	}
+	return writeTransferStatus(w, code, args...)
+}
+
+func writeTransferStatus(w *pktlineWriter, code int, args ...string) error {
+	if err := w.writeLine(fmt.Sprintf("status %d", code)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := w.writeLine(arg); err != nil {
+			return err
+		}
+	}
+	return w.flush()
+}
+
+// The size=N argument of a request
+func (req *transferRequest) size() (int64, error) {
+	size, err := strconv.ParseInt(req.args["size"], 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid size '%v'", req.args["size"])
+	}
+	return size, nil
+}
+
+func transferVersion(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error {
+	if req.arg != "1" {
+		return req.fail(w, 400, "Unsupported version %v", req.arg)
+	}
+	return req.succeed(w)
+}
+
+func transferBatch(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error {
+	type batchObject struct {
+		oid  string
+		size int64
+	}
+	var objects []batchObject
+	if req.data != nil {
+		scanner := bufio.NewScanner(req.data)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				return req.fail(w, 400, "Invalid object '%v'", scanner.Text())
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || size < 0 || !validOid(fields[0]) {
+				return req.fail(w, 400, "Invalid object '%v'", scanner.Text())
+			}
+			objects = append(objects, batchObject{fields[0], size})
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	if algo := req.args["hash-algo"]; algo != "" && algo != "sha256" {
+		return req.fail(w, 400, "Unsupported hash algorithm %v", algo)
+	}
+	if transfer := req.args["transfer"]; transfer != "" && transfer != "basic" {
+		return req.fail(w, 400, "Unsupported transfer %v", transfer)
+	}
+	logf("Transfer batch: %d objects requested for %v\n", len(objects), sess.Operation)
+
+	type batchResult struct {
+		oid    string
+		size   int64
+		action string
+		// Non-zero if the object can't be transferred as asked
+		code int
+	}
+	var results []batchResult
+	var uploadsize int64
+	for _, o := range objects {
+		r := batchResult{oid: o.oid, size: o.size, action: "noop"}
+		size, err := sess.Store.Size(path, o.oid)
+		if err == nil && size != o.size {
+			logf("Transfer batch: %v\n", sizeConflictMessage(o.oid, size, o.size))
+			// Uploads are still offered, so that put-object reports the conflict
+			// rather than the client taking the object as stored
+			if sess.Operation == transferUpload {
+				r.action = transferUpload
+			}
+			r.code = 409
+		} else if sess.Operation == transferUpload {
+			if err != nil {
+				r.action = transferUpload
+				uploadsize += o.size
+			}
+		} else if err == nil {
+			r.action = transferDownload
+		}
+		results = append(results, r)
+	}
+	if uploadsize > 0 {
+		usages := quotaUsages(config, sess.Store, sess.User, path)
+		if checkUsage(usages, uploadsize) != nil {
+			// Not everything fits, so uploads in order until the quota is reached
+			// are fine and the rest get an error, which put-object will report
+			uploadsize = 0
+			for i := range results {
+				r := &results[i]
+				if r.action != transferUpload || r.code != 0 {
+					continue
+				}
+				if err := checkUsage(usages, uploadsize+r.size); err != nil {
+					r.code = 413
+					continue
+				}
+				uploadsize += r.size
+			}
+		}
+	}
+
+	if err := w.writeLine("status 200"); err != nil {
+		return err
+	}
+	if err := w.writeDelim(); err != nil {
+		return err
+	}
+	for _, r := range results {
+		line := fmt.Sprintf("%v %d %v", r.oid, r.size, r.action)
+		if r.code != 0 {
+			line += fmt.Sprintf(" error=%d", r.code)
+		}
+		if err := w.writeLine(line); err != nil {
+			return err
+		}
+	}
+	return w.flush()
+}
+
+func transferGetObject(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error {
+	oid := req.arg
+	if !validOid(oid) {
+		return req.fail(w, 400, "Invalid oid '%v'", oid)
+	}
+	size, err := sess.Store.Size(path, oid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return req.fail(w, 404, "Object %v does not exist", oid)
+		}
+		return req.fail(w, 500, "%v", err.Error())
+	}
+	f, err := sess.Store.Open(path, oid)
+	if err != nil {
+		return req.fail(w, 500, "%v", err.Error())
+	}
+	defer f.Close()
+	logf("Transfer get-object: sending %v (%d bytes)\n", oid, size)
+	if err := w.writeLine("status 200"); err != nil {
+		return err
+	}
+	if err := w.writeLine(fmt.Sprintf("size=%d", size)); err != nil {
+		return err
+	}
+	if err := w.writeDelim(); err != nil {
+		return err
+	}
+	// Too late for an error response once content is being sent, so any failure ends the session
+	n, err := io.CopyN(w, f, size)
+	if err != nil {
+		return fmt.Errorf("Error sending %v after %d bytes: %v", oid, n, err.Error())
+	}
+	return w.flush()
+}
+
+func transferPutObject(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error {
+	oid := req.arg
+	if !validOid(oid) {
+		return req.fail(w, 400, "Invalid oid '%v'", oid)
+	}
+	size, err := req.size()
+	if err != nil {
+		return req.fail(w, 400, "%v", err.Error())
+	}
+	if req.data == nil {
+		return req.fail(w, 400, "No content sent for %v", oid)
+	}
+	if stored, err := sess.Store.Size(path, oid); err == nil {
+		if stored != size {
+			return req.fail(w, 409, "%v", sizeConflictMessage(oid, stored, size))
+		}
+		logf("Transfer put-object: content already exists for %v\n", oid)
+		return req.succeed(w)
+	}
+	if err := checkQuota(config, sess.Store, sess.User, path, size); err != nil {
+		return req.fail(w, 507, "%v", err.Error())
+	}
+	lock, exists, err := lockUpload(oid, sess.Store, config, path, false)
+	if err != nil {
+		return req.fail(w, 409, "%v", err.Error())
+	}
+	if exists {
+		logf("Transfer put-object: content for %v was uploaded by another connection\n", oid)
+		return req.succeed(w)
+	}
+	defer lock.release()
+
+	logf("Transfer put-object: receiving %v (%d bytes)\n", oid, size)
+	err = receivePartial(req.data, oid, size, 0, sess.Store, config, path)
+	if err != nil {
+		return req.fail(w, 400, "%v", err.Error())
+	}
+	logf("Transfer put-object: content for %v received\n", oid)
+	recordUpload(config, sess.User, path, oid, size)
+	return req.succeed(w)
+}
+
+func transferVerifyObject(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error {
+	oid := req.arg
+	if !validOid(oid) {
+		return req.fail(w, 400, "Invalid oid '%v'", oid)
+	}
+	size, err := req.size()
+	if err != nil {
+		return req.fail(w, 400, "%v", err.Error())
+	}
+	stored, err := sess.Store.Size(path, oid)
+	if err != nil {
+		return req.fail(w, 404, "Object %v does not exist", oid)
+	}
+	if stored != size {
+		return req.fail(w, 409, "%v", sizeConflictMessage(oid, stored, size))
+	}
+	return req.succeed(w)
+}
+
+// A lock as response arguments
+func transferLockArgs(l *FileLock) []string {
+	return []string{
+		"id=" + l.Id,
+		"path=" + l.Path,
+		"locked-at=" + l.LockedAt.Format(time.RFC3339),
+		"ownername=" + l.Owner.Name,
+	}
+}
+
+// Send the error from a lock operation, with the lock concerned if there is one
+func (req *transferRequest) failLock(w *pktlineWriter, err error) error {
+	lerr, ok := err.(*lockError)
+	if !ok {
+		return req.fail(w, 500, "%v", err.Error())
+	}
+	var args []string
+	if lerr.Lock != nil {
+		args = transferLockArgs(lerr.Lock)
+	}
+	return req.failWithArgs(w, lerr.Code, args, lerr.Message)
+}
+
+func transferLock(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error {
+	lock, err := createLock(config, path, req.args["path"], sess.User)
+	if err != nil {
+		return req.failLock(w, err)
+	}
+	return req.respond(w, 201, transferLockArgs(lock)...)
+}
+
+func transferListLock(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error {
+	limit := 0
+	if v := req.args["limit"]; v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			return req.fail(w, 400, "Invalid limit '%v'", v)
+		}
+	}
+	locks, next, err := listLocks(config, path, req.args["path"], req.args["id"], req.args["cursor"], limit)
+	if err != nil {
+		return req.failLock(w, err)
+	}
+	if req.data != nil {
+		if err := req.data.drain(); err != nil {
+			return err
+		}
+	}
+	if err := w.writeLine("status 200"); err != nil {
+		return err
+	}
+	if next != "" {
+		if err := w.writeLine("next-cursor=" + next); err != nil {
+			return err
+		}
+	}
+	if err := w.writeDelim(); err != nil {
+		return err
+	}
+	for _, l := range locks {
+		owner := "theirs"
+		if sess.User != nil && l.Owner.Name == sess.User.Name {
+			owner = "ours"
+		}
+		lines := []string{
+			"lock " + l.Id,
+			fmt.Sprintf("path %v %v", l.Id, l.Path),
+			fmt.Sprintf("locked-at %v %v", l.Id, l.LockedAt.Format(time.RFC3339)),
+			fmt.Sprintf("ownername %v %v", l.Id, l.Owner.Name),
+			fmt.Sprintf("owner %v %v", l.Id, owner),
+		}
+		for _, line := range lines {
+			if err := w.writeLine(line); err != nil {
+				return err
+			}
+		}
+	}
+	return w.flush()
+}
+
+func transferUnlock(req *transferRequest, w *pktlineWriter, config *Config, path string, sess *Session) error {
+	lock, err := deleteLock(config, path, req.arg, req.args["force"] == "true", sess.User)
+	if err != nil {
+		return req.failLock(w, err)
+	}
+	return req.succeed(w, transferLockArgs(lock)...)
+}
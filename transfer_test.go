@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/sinbad/git-lfs-ssh-serve/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("git-lfs-transfer protocol", func() {
+
+	var config *Config
+	var repopath string
+	var cli net.Conn
+	var pr *pktlineReader
+	var pw *pktlineWriter
+	var done chan int
+
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lfs-serve-test")
+		os.MkdirAll(config.BasePath, 0755)
+		repopath = "test/repo"
+	})
+	AfterEach(func() {
+		cli.Close()
+		<-done
+		os.RemoveAll(config.BasePath)
+	})
+
+	start := func(operation string, user *User) {
+		var srv net.Conn
+		cli, srv = net.Pipe()
+		done = make(chan int, 1)
+		go func() {
+			done <- ServeTransfer(srv, srv, GinkgoWriter, config, repopath, operation, user)
+			srv.Close()
+		}()
+		pr = newPktlineReader(cli)
+		pw = newPktlineWriter(cli)
+
+		caps, end, err := pr.readLines()
+		Expect(err).To(BeNil(), "Server should advertise capabilities")
+		Expect(end).To(Equal(pktFlush))
+		Expect(caps).To(ContainElement("version=1"))
+		pw.writeLine("version 1")
+		pw.flush()
+		status, _, _ := pr.readLines()
+		Expect(status).To(Equal([]string{"status 200"}), "Server should accept version 1")
+	}
+	// Send a request with optional args & data, where data is either lines or raw content
+	send := func(command string, args []string, data interface{}) {
+		pw.writeLine(command)
+		for _, a := range args {
+			pw.writeLine(a)
+		}
+		if data != nil {
+			pw.writeDelim()
+			switch d := data.(type) {
+			case []string:
+				for _, line := range d {
+					pw.writeLine(line)
+				}
+			case []byte:
+				pw.Write(d)
+			}
+		}
+		Expect(pw.flush()).To(Succeed())
+	}
+	// Read a response, returning the status line & args, and data lines if there are any
+	readResponse := func() (status []string, data []string) {
+		status, end, err := pr.readLines()
+		Expect(err).To(BeNil(), "Should read response")
+		if end == pktDelim {
+			data, _, err = pr.readLines()
+			Expect(err).To(BeNil(), "Should read response data")
+		}
+		return status, data
+	}
+
+	It("Uploads objects", func() {
+		start(transferUpload, nil)
+		content := []byte(strings.Repeat("content which spans several packets ", 5000))
+		oid := oidFor(content)
+		existing := []byte("already here")
+		send("put-object "+oidFor(existing), []string{fmt.Sprintf("size=%d", len(existing))}, existing)
+		status, _ := readResponse()
+		Expect(status).To(Equal([]string{"status 200"}))
+
+		send("batch", []string{"transfer=basic", "hash-algo=sha256"}, []string{
+			fmt.Sprintf("%v %d", oid, len(content)),
+			fmt.Sprintf("%v %d", oidFor(existing), len(existing)),
+		})
+		status, results := readResponse()
+		Expect(status).To(Equal([]string{"status 200"}))
+		Expect(results).To(Equal([]string{
+			fmt.Sprintf("%v %d upload", oid, len(content)),
+			fmt.Sprintf("%v %d noop", oidFor(existing), len(existing)),
+		}), "Only missing objects should be uploaded")
+
+		send("batch", nil, []string{fmt.Sprintf("%v -1000", oidFor([]byte("negative")))})
+		status, _ = readResponse()
+		Expect(status).To(Equal([]string{"status 400"}), "Negative sizes should be refused")
+
+		send("put-object "+oid, []string{fmt.Sprintf("size=%d", len(content))}, content)
+		status, _ = readResponse()
+		Expect(status).To(Equal([]string{"status 200"}), "Upload should succeed")
+		filename, _ := mediaPath(oid, config, repopath)
+		stored, _ := ioutil.ReadFile(filename)
+		Expect(stored).To(Equal(content), "Content should be stored")
+
+		send("verify-object "+oid, []string{fmt.Sprintf("size=%d", len(content))}, nil)
+		status, _ = readResponse()
+		Expect(status).To(Equal([]string{"status 200"}), "Uploaded object should verify")
+
+		bad := []byte("this doesn't match the oid")
+		send("put-object "+oidFor([]byte("something else")), []string{fmt.Sprintf("size=%d", len(bad))}, bad)
+		status, msg := readResponse()
+		Expect(status).To(Equal([]string{"status 400"}), "Bad content should be rejected")
+		Expect(msg[0]).To(ContainSubstring("failed verification"))
+
+		send("quit", nil, nil)
+		status, _ = readResponse()
+		Expect(status).To(Equal([]string{"status 200"}))
+		Expect(<-done).To(BeZero())
+		done <- 0
+	})
+
+	It("Downloads objects", func() {
+		content := []byte("content to download")
+		oid := oidFor(content)
+		filename, _ := mediaPath(oid, config, repopath)
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		ioutil.WriteFile(filename, content, 0644)
+		missing := oidFor([]byte("missing"))
+		start(transferDownload, nil)
+
+		send("batch", nil, []string{fmt.Sprintf("%v 19", oid), fmt.Sprintf("%v 7", missing), fmt.Sprintf("%v 20", oid)})
+		_, results := readResponse()
+		Expect(results).To(Equal([]string{oid + " 19 download", missing + " 7 noop", oid + " 20 noop error=409"}))
+
+		send("get-object "+oid, nil, nil)
+		status, end, err := pr.readLines()
+		Expect(err).To(BeNil())
+		Expect(status).To(Equal([]string{"status 200", "size=19"}))
+		Expect(end).To(Equal(pktDelim))
+		data := &pktDataReader{p: pr}
+		received, _ := ioutil.ReadAll(data)
+		Expect(received).To(Equal(content), "Should receive the content")
+
+		send("get-object "+missing, nil, nil)
+		status, msg := readResponse()
+		Expect(status).To(Equal([]string{"status 404"}))
+		Expect(msg[0]).To(ContainSubstring("does not exist"))
+
+		send("put-object "+oid, []string{"size=19"}, content)
+		status, _ = readResponse()
+		Expect(status).To(Equal([]string{"status 200"}), "Existing content needn't be written")
+	})
+
+	It("Reports objects stored with a different size", func() {
+		content := []byte("content which was truncated when stored")
+		oid := oidFor(content)
+		filename, _ := mediaPath(oid, config, repopath)
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		ioutil.WriteFile(filename, content[:10], 0644)
+		start(transferUpload, nil)
+
+		send("batch", nil, []string{fmt.Sprintf("%v %d", oid, len(content))})
+		status, results := readResponse()
+		Expect(status).To(Equal([]string{"status 200"}))
+		Expect(results).To(Equal([]string{fmt.Sprintf("%v %d upload error=409", oid, len(content))}),
+			"Truncated object shouldn't be taken as stored")
+
+		send("put-object "+oid, []string{fmt.Sprintf("size=%d", len(content))}, content)
+		status, msg := readResponse()
+		Expect(status).To(Equal([]string{"status 409"}))
+		Expect(msg[0]).To(ContainSubstring("Size conflict"))
+	})
+
+	It("Reports objects which would exceed a quota per object", func() {
+		config.Quotas = []*Quota{{Name: "test", Paths: []string{"test/*"}, Limit: 100}}
+		start(transferUpload, nil)
+		one, two := oidFor([]byte("one")), oidFor([]byte("two"))
+		send("batch", nil, []string{one + " 60", two + " 60"})
+		status, results := readResponse()
+		Expect(status).To(Equal([]string{"status 200"}), "Objects over quota shouldn't fail the whole batch")
+		Expect(results).To(Equal([]string{one + " 60 upload", two + " 60 upload error=413"}))
+	})
+
+	It("Locks files", func() {
+		start(transferUpload, &User{Name: "alice"})
+		send("lock", []string{"path=art/hero.psd", "refname=refs/heads/main"}, nil)
+		status, _ := readResponse()
+		Expect(status[0]).To(Equal("status 201"))
+		Expect(status).To(ContainElement("path=art/hero.psd"))
+		Expect(status).To(ContainElement("ownername=alice"))
+		id := strings.TrimPrefix(status[1], "id=")
+
+		send("lock", []string{"path=art/hero.psd"}, nil)
+		status, msg := readResponse()
+		Expect(status[0]).To(Equal("status 409"), "Files can only be locked once")
+		Expect(status).To(ContainElement("id="+id), "Conflict should describe the existing lock")
+		Expect(msg[0]).To(ContainSubstring("already locked by alice"))
+
+		send("list-lock", []string{"refname=refs/heads/main"}, nil)
+		status, locks := readResponse()
+		Expect(status).To(Equal([]string{"status 200"}))
+		Expect(locks).To(ContainElement("lock " + id))
+		Expect(locks).To(ContainElement("path " + id + " art/hero.psd"))
+		Expect(locks).To(ContainElement("owner " + id + " ours"))
+
+		send("unlock "+id, nil, nil)
+		status, _ = readResponse()
+		Expect(status[0]).To(Equal("status 200"))
+		send("unlock "+id, nil, nil)
+		status, _ = readResponse()
+		Expect(status[0]).To(Equal("status 404"))
+	})
+
+	It("Checks permissions", func() {
+		config.AccessRules = []*AccessRule{{Users: []string{"*"}, Paths: []string{"**"}, Permission: PermissionRead}}
+		var srv net.Conn
+		cli, srv = net.Pipe()
+		done = make(chan int, 1)
+		done <- ServeTransfer(srv, srv, GinkgoWriter, config, repopath, transferUpload, &User{Name: "carol"})
+		Expect(<-done).To(Equal(20), "Read-only users can't start an upload")
+		done <- 0
+
+		start(transferDownload, &User{Name: "carol"})
+		send("put-object "+oidFor([]byte("x")), []string{"size=1"}, []byte("x"))
+		status, msg := readResponse()
+		Expect(status).To(Equal([]string{"status 403"}))
+		Expect(msg[0]).To(ContainSubstring("Permission denied"))
+	})
+})